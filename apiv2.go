@@ -0,0 +1,272 @@
+package main
+
+import (
+	_ "embed" // specyfikacja OpenAPI wkompilowana w program
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const pageLimit = 100
+const pageMaxLimit = 1000
+
+//go:embed openapi.yaml
+var openapiSpec []byte
+
+// Page - Strona wyników
+// ========================================================
+type Page struct {
+	Total  int         `json:"Total"`
+	Offset int         `json:"Offset"`
+	Limit  int         `json:"Limit"`
+	Items  interface{} `json:"Items"`
+}
+
+// StateDoc - Stan maszyny w API v2
+// ========================================================
+type StateDoc struct {
+	ID     int           `json:"ID"`
+	Hex    string        `json:"Hex"`
+	Bits   []string      `json:"Bits"`
+	Count  int           `json:"Count"`
+	Analog []AnalogRange `json:"Analog,omitempty"`
+}
+
+// TransitionDoc - Przejście między stanami w API v2
+// ========================================================
+type TransitionDoc struct {
+	ID          int   `json:"ID"`
+	Src         int   `json:"Src"`
+	Dst         int   `json:"Dst"`
+	Time        int64 `json:"Time"`
+	Uncertainty int64 `json:"Uncertainty"`
+}
+
+// ErrorDoc - Błąd w API v2
+// ========================================================
+type ErrorDoc struct {
+	Error string `json:"Error"`
+}
+
+// ImageBits - Lista ustawionych bitów obrazu (adresy S7)
+// ================================================================================================
+func ImageBits(image [imageSize]byte) []string {
+	bits := []string{}
+	for index := 0; index < imageSize; index++ {
+		for bit := 0; bit < 8; bit++ {
+			if image[index]&(1<<uint(bit)) != 0 {
+				bits = append(bits, FormatAddress(index, bit))
+			}
+		}
+	}
+	return bits
+}
+
+// StateDocument - Stan z modelu jako dokument API v2
+// ================================================================================================
+func (m *Model) StateDocument(k int) StateDoc {
+	doc := StateDoc{
+		ID:   k,
+		Hex:  hex.EncodeToString(m.machineStates[k][:]),
+		Bits: ImageBits(m.machineStates[k]),
+	}
+	if k < len(m.statesStatistics) {
+		doc.Count = m.statesStatistics[k]
+	}
+	if k < len(m.statesAnalog) {
+		doc.Analog = m.statesAnalog[k]
+	}
+	return doc
+}
+
+// pageParams - Parametry stronicowania z zapytania
+// ================================================================================================
+func pageParams(c *gin.Context) (int, int, bool) {
+	offset, err1 := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, err2 := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(pageLimit)))
+	if err1 != nil || err2 != nil || offset < 0 || limit <= 0 || limit > pageMaxLimit {
+		c.JSON(http.StatusBadRequest, ErrorDoc{Error: "niepoprawne parametry offset/limit"})
+		return 0, 0, false
+	}
+	return offset, limit, true
+}
+
+// intParam - Opcjonalny parametr liczbowy z zapytania (-1 gdy brak)
+// ================================================================================================
+func intParam(c *gin.Context, name string) (int, bool) {
+	str := c.Query(name)
+	if str == "" {
+		return -1, true
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorDoc{Error: "niepoprawny parametr " + name})
+		return 0, false
+	}
+	return value, true
+}
+
+// paginate - Wycięcie strony z listy wyników
+// ================================================================================================
+func paginate(total int, offset int, limit int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+// GetStatesV2 - Lista stanów (filtry: minCount, bit)
+// ================================================================================================
+func GetStatesV2(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetStatesV2()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	offset, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	minCount, ok := intParam(c, "minCount")
+	if !ok {
+		return
+	}
+	var filterBit Address
+	if bit := c.Query("bit"); bit != "" {
+		addr, err := ParseAddress(bit)
+		if err != nil || addr.Bit < 0 {
+			c.JSON(http.StatusBadRequest, ErrorDoc{Error: "niepoprawny adres bitu " + bit})
+			return
+		}
+		filterBit = addr
+	} else {
+		filterBit.Bit = -1
+	}
+
+	m := model
+	states := []StateDoc{}
+	for k := range m.machineStates {
+		doc := m.StateDocument(k)
+		if minCount >= 0 && doc.Count < minCount {
+			continue
+		}
+		if filterBit.Bit >= 0 && m.machineStates[k][filterBit.Offset]&(1<<uint(filterBit.Bit)) == 0 {
+			continue
+		}
+		states = append(states, doc)
+	}
+
+	from, to := paginate(len(states), offset, limit)
+	c.JSON(http.StatusOK, Page{Total: len(states), Offset: offset, Limit: limit, Items: states[from:to]})
+}
+
+// GetStateV2 - Pojedynczy stan
+// ================================================================================================
+func GetStateV2(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetStateV2()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	m := model
+	k, err := strconv.Atoi(c.Param("id"))
+	if err != nil || k < 0 || k >= len(m.machineStates) {
+		c.JSON(http.StatusNotFound, ErrorDoc{Error: "nie znaleziono stanu " + c.Param("id")})
+		return
+	}
+	c.JSON(http.StatusOK, m.StateDocument(k))
+}
+
+// GetTransitionsV2 - Lista przejść (filtry: src, dst, minTime, maxTime)
+// ================================================================================================
+func GetTransitionsV2(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetTransitionsV2()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	offset, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	filters := map[string]int{}
+	for _, name := range []string{"src", "dst", "minTime", "maxTime"} {
+		value, ok := intParam(c, name)
+		if !ok {
+			return
+		}
+		filters[name] = value
+	}
+
+	transitions := []TransitionDoc{}
+	for i, trans := range model.Transisions {
+		if filters["src"] >= 0 && trans.StateNrSrc != filters["src"] ||
+			filters["dst"] >= 0 && trans.StateNrDst != filters["dst"] ||
+			filters["minTime"] >= 0 && trans.Time < int64(filters["minTime"]) ||
+			filters["maxTime"] >= 0 && trans.Time > int64(filters["maxTime"]) {
+			continue
+		}
+		transitions = append(transitions, TransitionDoc{
+			ID:          i,
+			Src:         trans.StateNrSrc,
+			Dst:         trans.StateNrDst,
+			Time:        trans.Time,
+			Uncertainty: trans.Uncertainty,
+		})
+	}
+
+	from, to := paginate(len(transitions), offset, limit)
+	c.JSON(http.StatusOK, Page{Total: len(transitions), Offset: offset, Limit: limit, Items: transitions[from:to]})
+}
+
+// GetCyclesV2 - Znalezione cykle [ms]
+// ================================================================================================
+func GetCyclesV2(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetCyclesV2()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	cycles := model.cyclesFound
+	if cycles == nil {
+		cycles = []int64{}
+	}
+	c.JSON(http.StatusOK, cycles)
+}
+
+// GetModelV2 - Podsumowanie aktualnego modelu
+// ================================================================================================
+func GetModelV2(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetModelV2()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	summary := model.Summary()
+	if summary.Cycles == nil {
+		summary.Cycles = []int64{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"Etap":  etap,
+		"Model": summary,
+	})
+}
+
+// GetOpenAPI - Specyfikacja OpenAPI 3
+// ================================================================================================
+func GetOpenAPI(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Data(http.StatusOK, "application/yaml", openapiSpec)
+}
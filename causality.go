@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parametry analizy przyczynowości - domyślne wartości zapytania
+const causalityWindow = 2000
+const causalityMinSupport = 3
+const causalityMinProbability = 0.5
+const causalityLimit = 20
+
+// edgeNames - Nazwy zboczy w opisie zależności
+var edgeNames = map[bool]string{true: "rise", false: "fall"}
+var edgeTexts = map[bool]string{true: "narastające", false: "opadające"}
+var edgeAfter = map[bool]string{true: "narastającym", false: "opadającym"}
+
+// signalEdge - Zbocze sygnału bitowego w timeline
+// Time - chwila obrazu z nową wartością (ImageTime), Timestamp - czas serwera (do sprawdzenia STOP CPU)
+// ========================================================
+type signalEdge struct {
+	Time      int64
+	Timestamp int64
+	Rising    bool
+}
+
+// CausalLink - Zbocze sygnału poprzedzające zbocze sygnału docelowego
+// Probability - P(zbocze Cause najwyżej Window przed zboczem Target | zbocze Target)
+// Reverse - P(zbocze Target najwyżej Window po zboczu Cause | zbocze Cause)
+// Lag - opóźnienie Target względem ostatniego zbocza Cause [ms]
+// ========================================================
+type CausalLink struct {
+	Target      string  `json:"Target"`
+	TargetEdge  string  `json:"TargetEdge"`
+	Cause       string  `json:"Cause"`
+	CauseEdge   string  `json:"CauseEdge"`
+	Count       int     `json:"Count"` // zbocza Target
+	Hits        int     `json:"Hits"`  // zbocza Target poprzedzone zboczem Cause
+	Probability float64 `json:"Probability"`
+	Reverse     float64 `json:"Reverse"`
+	MeanLag     float64 `json:"MeanLag"`
+	MinLag      int64   `json:"MinLag"`
+	P50Lag      int64   `json:"P50Lag"`
+	P95Lag      int64   `json:"P95Lag"`
+	MaxLag      int64   `json:"MaxLag"`
+	Text        string  `json:"Text"`
+}
+
+// CausalityReport - Zależności czasowe wybranych sygnałów
+// Uncertainty - niepewność opóźnień z próbkowania [ms], opóźnienie 0 - zmiana w tym samym obrazie
+// ========================================================
+type CausalityReport struct {
+	Window      int64        `json:"Window"`
+	Uncertainty int64        `json:"Uncertainty"`
+	Links       []CausalLink `json:"Links"`
+}
+
+// SignalEdges - Zbocza sygnału bitowego (zmiany przez STOP CPU pomijamy)
+// ================================================================================================
+func SignalEdges(timeline []MachineImage, s Signal) []signalEdge {
+	var edges []signalEdge
+	mask := byte(1 << uint(s.addr.Bit))
+	for i := 1; i < len(timeline); i++ {
+		prev := timeline[i-1].IOImage[s.addr.Offset] & mask
+		curr := timeline[i].IOImage[s.addr.Offset] & mask
+		if prev == curr || CPUStopBetween(timeline[i-1].Timestamp, timeline[i].Timestamp) {
+			continue
+		}
+		edges = append(edges, signalEdge{Time: ImageTime(timeline[i]), Timestamp: timeline[i].Timestamp, Rising: curr != 0})
+	}
+	return edges
+}
+
+// filterEdges - Zbocza jednego kierunku
+// ================================================================================================
+func filterEdges(edges []signalEdge, rising bool) []signalEdge {
+	var result []signalEdge
+	for _, e := range edges {
+		if e.Rising == rising {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// CausalLinkOf - Zależność zbocza target od zbocza cause w oknie window [ms]
+// ================================================================================================
+func CausalLinkOf(target []signalEdge, cause []signalEdge, window int64) CausalLink {
+	link := CausalLink{Count: len(target)}
+	windowNs := window * 1000000
+
+	// ostatnie zbocze cause nie później niż zbocze target
+	var lags []int64
+	for _, t := range target {
+		k := sort.Search(len(cause), func(i int) bool { return cause[i].Time > t.Time }) - 1
+		if k < 0 || t.Time-cause[k].Time > windowNs || CPUStopBetween(cause[k].Timestamp, t.Timestamp) {
+			continue
+		}
+		lags = append(lags, (t.Time-cause[k].Time)/1000000)
+	}
+
+	// pierwsze zbocze target nie wcześniej niż zbocze cause
+	followed := 0
+	for _, c := range cause {
+		k := sort.Search(len(target), func(i int) bool { return target[i].Time >= c.Time })
+		if k < len(target) && target[k].Time-c.Time <= windowNs && !CPUStopBetween(c.Timestamp, target[k].Timestamp) {
+			followed++
+		}
+	}
+
+	link.Hits = len(lags)
+	if link.Count > 0 {
+		link.Probability = float64(link.Hits) / float64(link.Count)
+	}
+	if len(cause) > 0 {
+		link.Reverse = float64(followed) / float64(len(cause))
+	}
+	if len(lags) == 0 {
+		return link
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+	var sum int64
+	for _, lag := range lags {
+		sum += lag
+	}
+	link.MeanLag = float64(sum) / float64(len(lags))
+	link.MinLag = lags[0]
+	link.P50Lag = Percentile(lags, 50)
+	link.P95Lag = Percentile(lags, 95)
+	link.MaxLag = lags[len(lags)-1]
+	return link
+}
+
+// AnalyzeCausality - Zbocza sygnałów candidates poprzedzające zbocza sygnałów targets
+// Zwracane są zależności z co najmniej minSupport trafieniami i prawdopodobieństwem od minProbability,
+// dla każdego zbocza sygnału docelowego najpierw najpewniejsze
+// ================================================================================================
+func AnalyzeCausality(timeline []MachineImage, targets []Signal, candidates []Signal, window int64, minSupport int, minProbability float64) []CausalLink {
+	causes := make([][]signalEdge, len(candidates))
+	for i, s := range candidates {
+		causes[i] = SignalEdges(timeline, s)
+	}
+
+	links := []CausalLink{}
+	for _, target := range targets {
+		edges := SignalEdges(timeline, target)
+		for _, rising := range []bool{true, false} {
+			targetEdges := filterEdges(edges, rising)
+			if len(targetEdges) == 0 {
+				continue
+			}
+			var group []CausalLink
+			for i, cause := range candidates {
+				if cause.addr.Offset == target.addr.Offset && cause.addr.Bit == target.addr.Bit {
+					continue
+				}
+				for _, causeRising := range []bool{true, false} {
+					link := CausalLinkOf(targetEdges, filterEdges(causes[i], causeRising), window)
+					if link.Hits < minSupport || link.Probability < minProbability {
+						continue
+					}
+					link.Target, link.TargetEdge = target.Name, edgeNames[rising]
+					link.Cause, link.CauseEdge = cause.Name, edgeNames[causeRising]
+					link.Text = target.Name + " - zbocze " + edgeTexts[rising] + " średnio " +
+						strconv.FormatFloat(link.MeanLag, 'f', 0, 64) + " ms po zboczu " + edgeAfter[causeRising] + " " +
+						cause.Name + " w " + strconv.FormatFloat(math.Floor(link.Probability*100), 'f', 0, 64) + "% przypadków"
+					group = append(group, link)
+				}
+			}
+			sortLinks(group)
+			links = append(links, group...)
+		}
+	}
+	return links
+}
+
+// sortLinks - Najpierw najpewniejsze zależności, przy równych najbardziej stałe i najkrótsze opóźnienie
+// (sygnał zmieniający się ciągle poprzedza wszystko, ale z przypadkowym opóźnieniem)
+// ================================================================================================
+func sortLinks(links []CausalLink) {
+	sort.SliceStable(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		if a.Probability != b.Probability {
+			return a.Probability > b.Probability
+		}
+		if a.Reverse != b.Reverse {
+			return a.Reverse > b.Reverse
+		}
+		if a.P95Lag-a.MinLag != b.P95Lag-b.MinLag {
+			return a.P95Lag-a.MinLag < b.P95Lag-b.MinLag
+		}
+		return a.MeanLag < b.MeanLag
+	})
+}
+
+// bitSignals - Sygnały bitowe z zapytania (adresy bitów lub zmienne BOOL)
+// ================================================================================================
+func bitSignals(str string) ([]Signal, error) {
+	signals, err := ParseSignals(str)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signals {
+		if s.addr.Bit < 0 {
+			return nil, errors.New("sygnał " + s.Name + " nie jest bitem")
+		}
+	}
+	return signals, nil
+}
+
+// GetCausality - Które zbocza sygnałów poprzedzają zbocza wybranych bitów i o ile
+// (signals - bity docelowe, candidates - bity przyczyn, domyślnie wszystkie zmieniające się,
+// from, to, window [ms], minSupport, minProbability, limit - zależności na zbocze bitu docelowego)
+// ================================================================================================
+func GetCausality(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetCausality()")
+
+	targets, err := bitSignals(c.Query("signals"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, "Brak parametru signals")
+		return
+	}
+	candidates, err := bitSignals(c.Query("candidates"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := ParseTimeParam(c.Query("from"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseTimeParam(c.Query("to"), math.MaxInt64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	params := map[string]int{"window": causalityWindow, "minSupport": causalityMinSupport, "limit": causalityLimit}
+	for name, value := range params {
+		if str := c.Query(name); str != "" {
+			v, err := strconv.Atoi(str)
+			if err != nil || v < 1 {
+				c.JSON(http.StatusBadRequest, "Niepoprawny parametr "+name)
+				return
+			}
+			value = v
+		}
+		params[name] = value
+	}
+	minProbability := causalityMinProbability
+	if str := c.Query("minProbability"); str != "" {
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil || v < 0 || v > 1 {
+			c.JSON(http.StatusBadRequest, "Niepoprawny parametr minProbability (0..1)")
+			return
+		}
+		minProbability = v
+	}
+
+	timeline := TimelineWindow(machineTimeline, from, to, nil, false)
+	if len(candidates) == 0 {
+		names, _ := ParseNames("")
+		candidates = ChangingBits(timeline)
+		for i := range candidates {
+			if name, ok := names[candidates[i].Name]; ok {
+				candidates[i].Name = name
+			}
+		}
+	}
+
+	links := AnalyzeCausality(timeline, targets, candidates, int64(params["window"]), params["minSupport"], minProbability)
+
+	// najwyżej limit zależności dla każdego zbocza bitu docelowego
+	report := CausalityReport{Window: int64(params["window"]), Uncertainty: SessionJitter().Uncertainty, Links: []CausalLink{}}
+	count := map[string]int{}
+	for _, link := range links {
+		key := link.Target + " " + link.TargetEdge
+		if count[key] < params["limit"] {
+			report.Links = append(report.Links, link)
+			count[key]++
+		}
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+// risingEdges - Zbocza narastające w chwilach [ms]
+// ================================================================================================
+func risingEdges(ms ...int64) []signalEdge {
+	var result []signalEdge
+	for _, m := range ms {
+		result = append(result, signalEdge{Time: m * 1000000, Timestamp: m * 1000000, Rising: true})
+	}
+	return result
+}
+
+// setCPUStop - Historia stanów CPU z jednym STOP [ms] (0 - bez), przywracana po teście
+// ================================================================================================
+func setCPUStop(t *testing.T, stop int64) {
+	cpuMutex.Lock()
+	saved := cpuChanges
+	cpuChanges = nil
+	if stop > 0 {
+		cpuChanges = []CPUStateChange{{Time: stop * 1000000, State: "STOP", Previous: "RUN"}}
+	}
+	cpuMutex.Unlock()
+	t.Cleanup(func() {
+		cpuMutex.Lock()
+		cpuChanges = saved
+		cpuMutex.Unlock()
+	})
+}
+
+// TestCausalLinkOf - Opóźnienia zboczy target względem zboczy cause w oknie czasu
+// ================================================================================================
+func TestCausalLinkOf(t *testing.T) {
+	t.Run("lags", func(t *testing.T) {
+		setCPUStop(t, 0)
+		l := CausalLinkOf(risingEdges(100, 1150, 2300), risingEdges(0, 1000, 2000), 500)
+		if l.Count != 3 || l.Hits != 3 || l.Probability != 1 || l.Reverse != 1 {
+			t.Errorf("counts %+v", l)
+		}
+		if l.MinLag != 100 || l.P50Lag != 150 || l.P95Lag != 300 || l.MaxLag != 300 || l.MeanLag != 550.0/3 {
+			t.Errorf("lags %+v", l)
+		}
+		// okno krótsze niż dwa z trzech opóźnień
+		l = CausalLinkOf(risingEdges(100, 1150, 2300), risingEdges(0, 1000, 2000), 120)
+		if l.Hits != 1 || l.Probability != 1.0/3 || l.Reverse != 1.0/3 || l.MaxLag != 100 {
+			t.Errorf("short window %+v", l)
+		}
+	})
+
+	t.Run("latest cause", func(t *testing.T) {
+		setCPUStop(t, 0)
+		l := CausalLinkOf(risingEdges(1000), risingEdges(0, 600, 900), 2000)
+		if l.Hits != 1 || l.MinLag != 100 || l.MaxLag != 100 {
+			t.Errorf("%+v", l)
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		setCPUStop(t, 0)
+		// zbocza w tym samym obrazie - przyczyna bez mierzalnego opóźnienia
+		if l := CausalLinkOf(risingEdges(500), risingEdges(500), 100); l.Hits != 1 || l.MaxLag != 0 {
+			t.Errorf("same image %+v", l)
+		}
+		if l := CausalLinkOf(risingEdges(0), risingEdges(100), 500); l.Count != 1 || l.Hits != 0 {
+			t.Errorf("cause after target %+v", l)
+		}
+		if l := CausalLinkOf(risingEdges(0, 100), nil, 500); l.Count != 2 || l.Hits != 0 || l.Probability != 0 {
+			t.Errorf("no cause edges %+v", l)
+		}
+	})
+
+	t.Run("CPU stop", func(t *testing.T) {
+		// STOP między zboczem cause a target przerywa związek
+		setCPUStop(t, 1050)
+		l := CausalLinkOf(risingEdges(100, 1100), risingEdges(0, 1000), 500)
+		if l.Count != 2 || l.Hits != 1 || l.Probability != 0.5 || l.MaxLag != 100 {
+			t.Errorf("%+v", l)
+		}
+	})
+}
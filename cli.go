@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// RunCommand - Polecenia z linii komend (zamiast serwera HTTP)
+// ================================================================================================
+func RunCommand(args []string) error {
+	switch args[0] {
+	case "vcd":
+		return CommandVCD(args[1:])
+	case "export":
+		return CommandExport(args[1:])
+	case "config":
+		return CommandConfig(args[1:])
+	}
+	return errors.New("nieznane polecenie " + args[0])
+}
+
+// timeWindowFlags - Wspólne flagi przedziału czasu i sygnałów
+// ================================================================================================
+func timeWindowFlags(fs *flag.FlagSet) (*string, *string, *string) {
+	from := fs.String("from", "", "początek przedziału (unix ns lub RFC3339)")
+	to := fs.String("to", "", "koniec przedziału (unix ns lub RFC3339)")
+	signals := fs.String("signals", "", "sygnały rozdzielone przecinkiem (adresy S7 lub nazwy zmiennych)")
+	return from, to, signals
+}
+
+// configFlag - Flaga pliku konfiguracji (zmienne typowane z sekcji tags)
+// ================================================================================================
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", os.Getenv("S7_CONFIG"), "plik konfiguracji YAML ze zmiennymi (zmienna S7_CONFIG)")
+}
+
+// loadTags - Zmienne typowane z pliku konfiguracji (bez pliku zostają bez zmian)
+// ================================================================================================
+func loadTags(path string) error {
+	if path == "" {
+		return nil
+	}
+	cfg := DefaultConfig()
+	if err := ReadConfigFile(&cfg, path); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	tags = cfg.Tags
+	return nil
+}
+
+// loadWindow - Nagranie z obrazami z wybranego przedziału czasu
+// ================================================================================================
+func loadWindow(in string, fromStr string, toStr string) (Recording, error) {
+	if in == "" {
+		return Recording{}, errors.New("brak pliku nagrania (-in)")
+	}
+	from, err := ParseTimeParam(fromStr, 0)
+	if err != nil {
+		return Recording{}, err
+	}
+	to, err := ParseTimeParam(toStr, math.MaxInt64)
+	if err != nil {
+		return Recording{}, err
+	}
+	rec, err := LoadRecordingData(in)
+	if err != nil {
+		return Recording{}, err
+	}
+	rec.Timeline = TimelineWindow(rec.Timeline, from, to, nil, false)
+	return rec, nil
+}
+
+// CommandVCD - Konwersja nagrania do formatu VCD
+// S7 vcd -in nagranie.jsonl -out przebiegi.vcd [-config] [-from] [-to] [-signals] [-names]
+// ================================================================================================
+func CommandVCD(args []string) error {
+	fs := flag.NewFlagSet("vcd", flag.ExitOnError)
+	in := fs.String("in", "", "plik nagrania (JSON lines z /api/v1/recording)")
+	out := fs.String("out", "", "plik wynikowy VCD (domyślnie standardowe wyjście)")
+	names := fs.String("names", "", "nazwy symboliczne adres:nazwa rozdzielone przecinkiem")
+	configPath := configFlag(fs)
+	from, to, signalsStr := timeWindowFlags(fs)
+	fs.Parse(args)
+
+	if err := loadTags(*configPath); err != nil {
+		return err
+	}
+
+	rec, err := loadWindow(*in, *from, *to)
+	if err != nil {
+		return err
+	}
+	images := rec.Timeline
+	signals, err := ParseSignals(*signalsStr)
+	if err != nil {
+		return err
+	}
+	namesMap, err := ParseNames(*names)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	if err := WriteVCD(w, images, signals, namesMap); err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Println("Zapisano", len(images), "obrazów do", *out)
+	}
+	return nil
+}
+
+// CommandExport - Eksport nagrania do CSV lub Parquet (timeline, stany, przejścia)
+// S7 export -in nagranie.jsonl -table timeline|states|transitions -format csv|parquet [-out] [-config] [-from] [-to] [-signals] [-changes]
+// Stany i przejścia pochodzą z modelu zbudowanego z nagrania (-precision, -period)
+// ================================================================================================
+func CommandExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	in := fs.String("in", "", "plik nagrania (JSON lines z /api/v1/recording)")
+	out := fs.String("out", "", "plik wynikowy (domyślnie standardowe wyjście)")
+	table := fs.String("table", "timeline", "tabela: timeline, states, transitions")
+	format := fs.String("format", "csv", "format: csv, parquet")
+	changes := fs.Bool("changes", false, "tylko obrazy ze zmianą wybranych sygnałów")
+	precision := fs.Int("precision", 0, "dokładność porównania obrazów przy budowie modelu")
+	period := fs.Int64("period", 100, "tolerancja czasu przejść [ms] przy budowie modelu")
+	configPath := configFlag(fs)
+	from, to, signalsStr := timeWindowFlags(fs)
+	fs.Parse(args)
+
+	if err := loadTags(*configPath); err != nil {
+		return err
+	}
+
+	rec, err := loadWindow(*in, *from, *to)
+	if err != nil {
+		return err
+	}
+	images := rec.Timeline
+	signals, err := ParseSignals(*signalsStr)
+	if err != nil {
+		return err
+	}
+	if len(signals) == 0 {
+		signals = ImageBytes()
+	}
+	columns := map[string][]exportColumn{"timeline": timelineColumns(signals), "states": stateColumns, "transitions": transitionColumns}[*table]
+	if columns == nil {
+		return errors.New("nieznana tabela " + *table + " (timeline, states, transitions)")
+	}
+	if err := CheckColumns(*format, columns); err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	var rows int
+	switch *table {
+	case "timeline":
+		rows, err = ExportTimeline(w, *format, images, 0, math.MaxInt64, signals, *changes)
+	case "states":
+		rows, err = ExportStates(w, *format, BuildRecordingModel(rec, *precision, *period))
+	case "transitions":
+		rows, err = ExportTransitions(w, *format, BuildRecordingModel(rec, *precision, *period))
+	default:
+		return errors.New("nieznana tabela " + *table + " (timeline, states, transitions)")
+	}
+	if err != nil {
+		return err
+	}
+	if *out != "" {
+		fmt.Println("Zapisano", rows, "wierszy do", *out)
+	}
+	return nil
+}
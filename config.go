@@ -0,0 +1,419 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PLCConfig - Parametry połączenia ze sterownikiem
+// ConnectionType - PG, OP lub BASIC; RemoteTSAP (np. "03.02") zastępuje typ połączenia, rack i slot
+// Lokalny TSAP nie jest ustawiany - gos7 używa zawsze 01.00
+// Areas - czytane obszary obrazu (M, E, A), pozostałe zostają wyzerowane
+// StatusInterval - co ile sprawdzać stan CPU (RUN/STOP), wartość ujemna - bez sprawdzania
+// Clock - opcjonalny znacznik czasu lub licznik cykli z DB czytany razem z obrazem
+// Buffer - bufor zdarzeń w DB zapisywany przez FB w PLC - zastępuje odczyt obszarów (bez gubienia krótkich zmian)
+// ========================================================
+type PLCConfig struct {
+	Name           string           `yaml:"name" json:"Name"`
+	Address        string           `yaml:"address" json:"Address"`
+	Rack           int              `yaml:"rack" json:"Rack"`
+	Slot           int              `yaml:"slot" json:"Slot"`
+	ConnectionType string           `yaml:"connection_type" json:"ConnectionType"`
+	RemoteTSAP     string           `yaml:"remote_tsap,omitempty" json:"RemoteTSAP,omitempty"`
+	Timeout        time.Duration    `yaml:"timeout" json:"Timeout"`
+	IdleTimeout    time.Duration    `yaml:"idle_timeout" json:"IdleTimeout"`
+	PDULength      int              `yaml:"pdu_length" json:"PDULength"`
+	Areas          []string         `yaml:"areas" json:"Areas"`
+	StatusInterval time.Duration    `yaml:"status_interval" json:"StatusInterval"`
+	Clock          *PLCClockConfig  `yaml:"clock,omitempty" json:"Clock,omitempty"`
+	Buffer         *PLCBufferConfig `yaml:"buffer,omitempty" json:"Buffer,omitempty"`
+}
+
+// AnalysisConfig - Parametry analizy cykli i modelu
+// ========================================================
+type AnalysisConfig struct {
+	CyclesTime       int   `yaml:"cycles_time" json:"CyclesTime"`        // [s] czas szukania cykli
+	CyclesTimeAdd    int   `yaml:"cycles_time_add" json:"CyclesTimeAdd"` // [s] wydłużenie przy zmniejszeniu dokładności
+	MinCycleTime     int64 `yaml:"min_cycle_time" json:"MinCycleTime"`   // [ms]
+	ComparePrecision int   `yaml:"compare_precision" json:"ComparePrecision"`
+	PeriodPrecision  int64 `yaml:"period_precision" json:"PeriodPrecision"` // [ms]
+}
+
+// Config - Konfiguracja programu (plik YAML, zmienne środowiskowe S7_*, flagi)
+// Tags - zmienne typowane ładowane przy starcie serwera i w poleceniach vcd, export
+// ========================================================
+type Config struct {
+	Listen     string         `yaml:"listen" json:"Listen"`
+	Recordings string         `yaml:"recordings" json:"Recordings"` // katalog nagrań do przebudowy modelu
+	PLCs       []PLCConfig    `yaml:"plcs" json:"PLCs"`
+	Tags       []Tag          `yaml:"tags" json:"Tags"`
+	Analysis   AnalysisConfig `yaml:"analysis" json:"Analysis"`
+	Stream     StreamConfig   `yaml:"stream" json:"Stream"`
+	MQTT       MqttConfig     `yaml:"mqtt" json:"MQTT"`
+}
+
+// config - Aktualna konfiguracja
+// ========================================================
+var config = DefaultConfig()
+
+// DefaultPLCConfig - Domyślne parametry połączenia
+// ================================================================================================
+func DefaultPLCConfig() PLCConfig {
+	return PLCConfig{
+		Rack:           0,
+		Slot:           0,
+		ConnectionType: "PG",
+		Timeout:        5 * time.Second,
+		IdleTimeout:    5 * time.Second,
+		PDULength:      960,
+		Areas:          []string{"M", "E", "A"},
+		StatusInterval: time.Second,
+	}
+}
+
+// DefaultConfig - Konfiguracja domyślna
+// ================================================================================================
+func DefaultConfig() Config {
+	return Config{
+		Listen:     ":80",
+		Recordings: "recordings",
+		Analysis: AnalysisConfig{
+			CyclesTime:      30,
+			CyclesTimeAdd:   15,
+			MinCycleTime:    2000,
+			PeriodPrecision: 100,
+		},
+		Stream: DefaultStreamConfig(),
+		MQTT:   DefaultMqttConfig(),
+	}
+}
+
+// Validate - Sprawdzenie parametrów połączenia
+// ================================================================================================
+func (p *PLCConfig) Validate() error {
+	name := p.Name
+	if name == "" {
+		name = p.Address
+	}
+	switch {
+	case net.ParseIP(p.Address) == nil:
+		return errors.New("niepoprawny adres IP PLC " + name)
+	case p.Rack < 0 || p.Rack > 7:
+		return errors.New("niepoprawny rack (0..7) dla PLC " + name)
+	case p.Slot < 0 || p.Slot > 31:
+		return errors.New("niepoprawny slot (0..31) dla PLC " + name)
+	case p.Timeout <= 0 || p.IdleTimeout <= 0:
+		return errors.New("niepoprawny timeout dla PLC " + name)
+	case p.PDULength < 240 || p.PDULength > 960:
+		return errors.New("niepoprawna długość PDU (240..960) dla PLC " + name)
+	case len(p.Areas) == 0:
+		return errors.New("brak obszarów do odczytu dla PLC " + name)
+	}
+	if err := p.validateConnection(name); err != nil {
+		return err
+	}
+	if p.Clock != nil {
+		if err := p.Clock.Validate(name); err != nil {
+			return err
+		}
+	}
+	if p.Buffer != nil {
+		if err := p.Buffer.Validate(name); err != nil {
+			return err
+		}
+	}
+	for i, area := range p.Areas {
+		area = strings.ToUpper(area)
+		switch area {
+		case "I":
+			area = "E"
+		case "Q":
+			area = "A"
+		}
+		if area != "M" && area != "E" && area != "A" {
+			return errors.New("nieznany obszar " + p.Areas[i] + " dla PLC " + name + " (M, E/I, A/Q)")
+		}
+		p.Areas[i] = area
+	}
+	return nil
+}
+
+// ReadsArea - Czy obszar (M, E, A) jest czytany
+// ================================================================================================
+func (p *PLCConfig) ReadsArea(area string) bool {
+	for _, a := range p.Areas {
+		if a == area {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate - Sprawdzenie całej konfiguracji
+// ================================================================================================
+func (cfg *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		return errors.New("niepoprawny adres nasłuchu " + cfg.Listen)
+	}
+	names := map[string]bool{}
+	for i := range cfg.PLCs {
+		p := &cfg.PLCs[i]
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if p.Name != "" {
+			if names[p.Name] {
+				return errors.New("powtórzona nazwa PLC " + p.Name)
+			}
+			names[p.Name] = true
+		}
+	}
+	tagNames := map[string]bool{}
+	for i := range cfg.Tags {
+		t := &cfg.Tags[i]
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		if tagNames[t.Name] {
+			return errors.New("powtórzona nazwa zmiennej " + t.Name)
+		}
+		tagNames[t.Name] = true
+	}
+
+	a := cfg.Analysis
+	switch {
+	case a.CyclesTime <= 0 || a.CyclesTimeAdd <= 0:
+		return errors.New("niepoprawny czas szukania cykli")
+	case a.MinCycleTime <= 0:
+		return errors.New("niepoprawny minimalny czas cyklu")
+	case a.ComparePrecision < 0 || a.ComparePrecision > imageSize:
+		return errors.New("niepoprawna dokładność porównania obrazów")
+	case a.PeriodPrecision <= 0:
+		return errors.New("niepoprawna tolerancja czasu przejść")
+	}
+
+	s := cfg.Stream
+	if s.DataInterval <= 0 || s.StatsInterval <= 0 || s.CyclesInterval <= 0 || s.PollInterval < 0 || s.Coalesce < 0 {
+		return errors.New("niepoprawne interwały strumienia")
+	}
+	if s.Push != "interval" && s.Push != "change" {
+		return errors.New("niepoprawny tryb push (interval, change)")
+	}
+	return cfg.MQTT.Validate()
+}
+
+// FindPLC - Parametry PLC po nazwie lub adresie (domyślne gdy nie ma w konfiguracji)
+// ================================================================================================
+func (cfg *Config) FindPLC(nameOrAddress string) PLCConfig {
+	for _, p := range cfg.PLCs {
+		if p.Name == nameOrAddress || p.Address == nameOrAddress {
+			return p
+		}
+	}
+	p := DefaultPLCConfig()
+	p.Address = nameOrAddress
+	return p
+}
+
+// configOverride - Parametr nadpisywany zmienną środowiskową i flagą
+// ========================================================
+type configOverride struct {
+	name  string // nazwa flagi, zmienna środowiskowa to S7_NAZWA
+	usage string
+	set   func(cfg *Config, value string) error
+}
+
+// configOverrides - Parametry dostępne jako flagi i zmienne środowiskowe
+// ========================================================
+var configOverrides = []configOverride{
+	{"listen", "adres nasłuchu HTTP (np. :80)", func(cfg *Config, v string) error {
+		cfg.Listen = v
+		return nil
+	}},
+	{"recordings", "katalog nagrań do przebudowy modelu", func(cfg *Config, v string) error {
+		cfg.Recordings = v
+		return nil
+	}},
+	{"cycles-time", "czas szukania cykli [s]", func(cfg *Config, v string) error {
+		return setInt(&cfg.Analysis.CyclesTime, v)
+	}},
+	{"cycles-time-add", "wydłużenie szukania cykli [s]", func(cfg *Config, v string) error {
+		return setInt(&cfg.Analysis.CyclesTimeAdd, v)
+	}},
+	{"min-cycle-time", "minimalny czas cyklu [ms]", func(cfg *Config, v string) error {
+		return setInt64(&cfg.Analysis.MinCycleTime, v)
+	}},
+	{"compare-precision", "dokładność porównania obrazów [bajty]", func(cfg *Config, v string) error {
+		return setInt(&cfg.Analysis.ComparePrecision, v)
+	}},
+	{"period-precision", "tolerancja czasu przejść [ms]", func(cfg *Config, v string) error {
+		return setInt64(&cfg.Analysis.PeriodPrecision, v)
+	}},
+	{"mqtt-broker", "broker MQTT (włącza wysyłanie, np. tcp://localhost:1883)", func(cfg *Config, v string) error {
+		cfg.MQTT.Broker = v
+		cfg.MQTT.Enabled = v != ""
+		return nil
+	}},
+	{"mqtt-topic", "szablon tematu MQTT ({plc}, {event})", func(cfg *Config, v string) error {
+		cfg.MQTT.Topic = v
+		return nil
+	}},
+	{"mqtt-format", "format MQTT (json, sparkplug)", func(cfg *Config, v string) error {
+		cfg.MQTT.Format = v
+		return nil
+	}},
+}
+
+// setInt - Parametr liczbowy z tekstu
+// ================================================================================================
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return errors.New("niepoprawna liczba " + v)
+	}
+	*dst = n
+	return nil
+}
+
+// setInt64 - Parametr liczbowy z tekstu
+// ================================================================================================
+func setInt64(dst *int64, v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return errors.New("niepoprawna liczba " + v)
+	}
+	*dst = n
+	return nil
+}
+
+// envName - Nazwa zmiennej środowiskowej dla parametru
+// ================================================================================================
+func envName(name string) string {
+	return "S7_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// ReadConfigFile - Konfiguracja z pliku YAML (na bazie domyślnej)
+// ================================================================================================
+func ReadConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	// PLC bez podanych parametrów dostają wartości domyślne
+	for i := range cfg.PLCs {
+		p := &cfg.PLCs[i]
+		def := DefaultPLCConfig()
+		if p.Timeout == 0 {
+			p.Timeout = def.Timeout
+		}
+		if p.IdleTimeout == 0 {
+			p.IdleTimeout = def.IdleTimeout
+		}
+		if p.PDULength == 0 {
+			p.PDULength = def.PDULength
+		}
+		if len(p.Areas) == 0 {
+			p.Areas = def.Areas
+		}
+		if p.StatusInterval == 0 {
+			p.StatusInterval = def.StatusInterval
+		}
+	}
+	return nil
+}
+
+// LoadConfig - Konfiguracja: domyślna < plik (-config lub S7_CONFIG) < zmienne S7_* < flagi
+// ================================================================================================
+func LoadConfig(name string, args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("S7_CONFIG"), "plik konfiguracji YAML (zmienna S7_CONFIG)")
+	flags := make(map[string]*string)
+	for _, o := range configOverrides {
+		flags[o.name] = fs.String(o.name, "", o.usage+" (zmienna "+envName(o.name)+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		if err := ReadConfigFile(&cfg, *path); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, o := range configOverrides {
+		if v, ok := os.LookupEnv(envName(o.name)); ok {
+			if err := o.set(&cfg, v); err != nil {
+				return cfg, errors.New(envName(o.name) + ": " + err.Error())
+			}
+		}
+	}
+	// tylko flagi podane jawnie
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := flags[f.Name]; ok && err == nil {
+			if e := configOverridesByName(f.Name).set(&cfg, *v); e != nil {
+				err = errors.New("-" + f.Name + ": " + e.Error())
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.Validate()
+}
+
+// configOverridesByName - Parametr o danej nazwie
+// ================================================================================================
+func configOverridesByName(name string) configOverride {
+	for _, o := range configOverrides {
+		if o.name == name {
+			return o
+		}
+	}
+	return configOverride{}
+}
+
+// ApplyConfig - Ustawienie parametrów programu z konfiguracji
+// ================================================================================================
+func ApplyConfig(cfg Config) error {
+	config = cfg
+	cyclesAnalyzeTime = cfg.Analysis.CyclesTime
+	cyclesAnalyzeTimeAdd = cfg.Analysis.CyclesTimeAdd
+	minCycleTime = cfg.Analysis.MinCycleTime
+	startingPrecision = cfg.Analysis.ComparePrecision
+	tags = append([]Tag(nil), cfg.Tags...)
+	return ConfigureMqtt(cfg.MQTT)
+}
+
+// CommandConfig - Sprawdzenie konfiguracji
+// S7 config check [-config plik.yaml] [flagi] - wypisuje konfigurację wynikową lub błąd
+// ================================================================================================
+func CommandConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("użycie: S7 config check [-config plik.yaml] [flagi]")
+	}
+	cfg, err := LoadConfig("config check", args[1:])
+	if err != nil {
+		return err
+	}
+	cfg.MQTT.Password = ""
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(out)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/robinson/gos7"
+)
+
+// CPUStateChange - Zmiana stanu CPU (RUN/STOP) - adnotacja timeline i zdarzenie "cpu"
+// ========================================================
+type CPUStateChange struct {
+	Time     int64  `json:"Time"`
+	State    string `json:"State"`
+	Previous string `json:"Previous"`
+}
+
+// Stan CPU aktualnej sesji i jego zmiany (od połączenia)
+// ========================================================
+var cpuState = "UNKNOWN"
+var cpuChanges []CPUStateChange
+var cpuStopStart int64
+var cpuMutex sync.Mutex
+
+// ResetCPUState - Nowa sesja - stan CPU nieznany, brak adnotacji
+// ================================================================================================
+func ResetCPUState() {
+	cpuMutex.Lock()
+	defer cpuMutex.Unlock()
+	cpuState = "UNKNOWN"
+	cpuChanges = nil
+	cpuStopStart = 0
+}
+
+// SetCPUState - Zapis stanu CPU odczytanego w chwili now, zwraca zmianę (false bez zmiany)
+// Czas w STOP nie liczy się do czasu szukania cykli (przesunięcie początku połączenia)
+// ================================================================================================
+func SetCPUState(session string, state string, now int64) (CPUStateChange, bool) {
+	if state != "RUN" && state != "STOP" {
+		return CPUStateChange{}, false
+	}
+	cpuMutex.Lock()
+	previous := cpuState
+	if state == previous {
+		cpuMutex.Unlock()
+		return CPUStateChange{}, false
+	}
+	change := CPUStateChange{Time: now, State: state, Previous: previous}
+	cpuState = state
+	cpuChanges = append(cpuChanges, change)
+	if state == "STOP" {
+		cpuStopStart = now
+	} else if cpuStopStart > 0 {
+		conectionTimeStart += int((now - cpuStopStart) / int64(time.Second))
+		cpuStopStart = 0
+	}
+	cpuMutex.Unlock()
+
+	log.Println("CPU", session, previous, "->", state)
+	running := 0.0
+	if state == "RUN" {
+		running = 1
+	}
+	metricCPURunning.WithLabelValues(session).Set(running)
+	PublishEvent(Event{Session: session, Type: "cpu", Time: now, Data: change})
+	return change, true
+}
+
+// CPUStopped - Czy CPU jest w STOP (nauka wstrzymana)
+// ================================================================================================
+func CPUStopped() bool {
+	cpuMutex.Lock()
+	defer cpuMutex.Unlock()
+	return cpuState == "STOP"
+}
+
+// CPUStopBetween - Czy między dwoma obrazami CPU było w STOP
+// Obrazy z czasu STOP nie trafiają do timeline, więc sąsiednie obrazy nie są ciągłym zachowaniem maszyny
+// ================================================================================================
+func CPUStopBetween(from int64, to int64) bool {
+	cpuMutex.Lock()
+	defer cpuMutex.Unlock()
+	return StopBetween(cpuChanges, from, to)
+}
+
+// StopBetween - Czy na liście zmian stanu CPU jest STOP między dwoma obrazami
+// ================================================================================================
+func StopBetween(changes []CPUStateChange, from int64, to int64) bool {
+	for _, change := range changes {
+		if change.State == "STOP" && change.Time > from && change.Time <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// CPUChanges - Zmiany stanu CPU w przedziale czasu
+// ================================================================================================
+func CPUChanges(from int64, to int64) []CPUStateChange {
+	cpuMutex.Lock()
+	defer cpuMutex.Unlock()
+	var changes []CPUStateChange
+	for _, change := range cpuChanges {
+		if change.Time >= from && change.Time <= to {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// cpuMonitor - Okresowe sprawdzanie stanu CPU w pętli odczytu
+// ========================================================
+type cpuMonitor struct {
+	session  string
+	interval time.Duration
+	last     int64
+}
+
+// Poll - Odczyt stanu CPU co interval, zwraca zmianę stanu (false bez zmiany)
+// ================================================================================================
+func (m *cpuMonitor) Poll(client gos7.Client, now int64) (CPUStateChange, bool) {
+	if m.interval <= 0 || time.Duration(now-m.last) < m.interval {
+		return CPUStateChange{}, false
+	}
+	m.last = now
+	var status int
+	err := SafeCall(func() error {
+		var err error
+		status, err = client.PLCGetStatus()
+		return err
+	})
+	if err != nil {
+		return CPUStateChange{}, false
+	}
+	return SetCPUState(m.session, CPUStateText(status), now)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dwellBins - Ilość przedziałów histogramu czasu pobytu
+const dwellBins = 10
+
+// dwellSamples - Najwięcej zapamiętanych czasów pobytu w stanie (próbka do percentyli i histogramu)
+const dwellSamples = 1000
+
+// DwellBin - Przedział histogramu czasu pobytu [ms] (From <= czas < To)
+// ========================================================
+type DwellBin struct {
+	From  int64 `json:"From"`
+	To    int64 `json:"To"`
+	Count int   `json:"Count"`
+}
+
+// DwellStats - Rozkład czasu pobytu maszyny w stanie [ms]
+// Share - udział stanu w całym czasie pobytów (gdzie maszyna traci czas cyklu)
+// Percentyle i histogram są liczone z próbki Samples pobytów (przy dłuższej pracy mniej niż Visits)
+// ========================================================
+type DwellStats struct {
+	State     int        `json:"State"`
+	Visits    int        `json:"Visits"`
+	Samples   int        `json:"Samples"`
+	Total     int64      `json:"Total"`
+	Share     float64    `json:"Share"`
+	Mean      float64    `json:"Mean"`
+	StdDev    float64    `json:"StdDev"`
+	Min       int64      `json:"Min"`
+	P50       int64      `json:"P50"`
+	P90       int64      `json:"P90"`
+	P95       int64      `json:"P95"`
+	P99       int64      `json:"P99"`
+	Max       int64      `json:"Max"`
+	Histogram []DwellBin `json:"Histogram"`
+}
+
+// DwellReport - Ranking stanów według łącznego czasu pobytu
+// ========================================================
+type DwellReport struct {
+	Total  int64        `json:"Total"`
+	States []DwellStats `json:"States"`
+}
+
+// dwellSketch - Czasy pobytu w stanie: dokładne sumy, średnia i wariancja (algorytm Welforda)
+// oraz równomierna próbka najwyżej dwellSamples czasów (reservoir sampling)
+// ========================================================
+type dwellSketch struct {
+	count    int
+	total    int64
+	min, max int64
+	mean, m2 float64
+	samples  []int64
+}
+
+// Add - Nowy czas pobytu [ms]
+// ================================================================================================
+func (d *dwellSketch) Add(t int64) {
+	d.count++
+	d.total += t
+	if d.count == 1 || t < d.min {
+		d.min = t
+	}
+	if d.count == 1 || t > d.max {
+		d.max = t
+	}
+	delta := float64(t) - d.mean
+	d.mean += delta / float64(d.count)
+	d.m2 += delta * (float64(t) - d.mean)
+
+	if len(d.samples) < dwellSamples {
+		d.samples = append(d.samples, t)
+	} else if k := rand.Intn(d.count); k < dwellSamples {
+		d.samples[k] = t
+	}
+}
+
+// Stats - Rozkład czasu pobytu w stanie k (liczności, średnia i skrajne wartości dokładne)
+// ================================================================================================
+func (d *dwellSketch) Stats(k int) DwellStats {
+	ds := DwellDistribution(k, d.samples)
+	if d.count == 0 {
+		return ds
+	}
+	ds.Visits, ds.Total = d.count, d.total
+	ds.Mean, ds.Min, ds.Max = d.mean, d.min, d.max
+	ds.StdDev = 0
+	if d.count > 1 {
+		ds.StdDev = math.Sqrt(d.m2 / float64(d.count-1))
+	}
+	return ds
+}
+
+// Percentile - Percentyl p (0..100) posortowanych wartości (metoda najbliższej rangi)
+// ================================================================================================
+func Percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// DwellDistribution - Statystyki i histogram czasów pobytu w stanie k
+// ================================================================================================
+func DwellDistribution(k int, times []int64) DwellStats {
+	ds := DwellStats{State: k, Visits: len(times), Samples: len(times), Histogram: []DwellBin{}}
+	if len(times) == 0 {
+		return ds
+	}
+	sorted := append([]int64(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, t := range sorted {
+		ds.Total += t
+	}
+	ds.Mean = float64(ds.Total) / float64(len(sorted))
+	if len(sorted) > 1 {
+		var sum float64
+		for _, t := range sorted {
+			sum += (float64(t) - ds.Mean) * (float64(t) - ds.Mean)
+		}
+		ds.StdDev = math.Sqrt(sum / float64(len(sorted)-1))
+	}
+	ds.Min = sorted[0]
+	ds.Max = sorted[len(sorted)-1]
+	ds.P50 = Percentile(sorted, 50)
+	ds.P90 = Percentile(sorted, 90)
+	ds.P95 = Percentile(sorted, 95)
+	ds.P99 = Percentile(sorted, 99)
+
+	// przedziały równej szerokości od Min do Max (co najmniej 1 ms)
+	width := (ds.Max - ds.Min + dwellBins) / dwellBins
+	for from := ds.Min; from <= ds.Max; from += width {
+		ds.Histogram = append(ds.Histogram, DwellBin{From: from, To: from + width})
+	}
+	for _, t := range sorted {
+		ds.Histogram[(t-ds.Min)/width].Count++
+	}
+	return ds
+}
+
+// DwellReport - Rozkłady czasów pobytu wszystkich stanów, od stanu z największym łącznym czasem
+// ================================================================================================
+func (m *Model) DwellReport() DwellReport {
+	report := DwellReport{States: []DwellStats{}}
+	for k := range m.dwell {
+		if m.dwell[k].count == 0 {
+			continue
+		}
+		ds := m.dwell[k].Stats(k)
+		report.Total += ds.Total
+		report.States = append(report.States, ds)
+	}
+	for i := range report.States {
+		if report.Total > 0 {
+			report.States[i].Share = float64(report.States[i].Total) / float64(report.Total)
+		}
+	}
+	sort.SliceStable(report.States, func(i, j int) bool { return report.States[i].Total > report.States[j].Total })
+	return report
+}
+
+// GetDwell - Ranking stanów według czasu pobytu z rozkładami (limit - ilość stanów)
+// ================================================================================================
+func GetDwell(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetDwell()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil || limit < 0 {
+		c.JSON(http.StatusBadRequest, "Niepoprawny parametr limit")
+		return
+	}
+
+	report := model.DwellReport()
+	if limit > 0 && len(report.States) > limit {
+		report.States = report.States[:limit]
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetDwellState - Rozkład czasu pobytu w jednym stanie
+// ================================================================================================
+func GetDwellState(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetDwellState()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	m := model
+	k, err := strconv.Atoi(c.Param("id"))
+	if err != nil || k < 0 || k >= len(m.dwell) {
+		c.JSON(http.StatusNotFound, "Nie znaleziono stanu "+c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, m.dwell[k].Stats(k))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// TestPercentile - Percentyl metodą najbliższej rangi
+// ================================================================================================
+func TestPercentile(t *testing.T) {
+	if got := Percentile(nil, 50); got != 0 {
+		t.Errorf("empty: %d", got)
+	}
+	if got := Percentile([]int64{7}, 0); got != 7 {
+		t.Errorf("single: %d", got)
+	}
+	ten := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	// najbliższa ranga - ceil(p/100*n), bez interpolacji
+	for p, want := range map[float64]int64{0: 1, 10: 1, 11: 2, 50: 5, 90: 9, 95: 10, 100: 10, 120: 10} {
+		if got := Percentile(ten, p); got != want {
+			t.Errorf("P%v = %d, want %d", p, got, want)
+		}
+	}
+}
+
+// TestDwellDistribution - Statystyki i histogram czasów pobytu
+// ================================================================================================
+func TestDwellDistribution(t *testing.T) {
+	empty := DwellDistribution(1, nil)
+	if empty.State != 1 || empty.Visits != 0 || empty.Histogram == nil || len(empty.Histogram) != 0 {
+		t.Errorf("empty: %+v", empty)
+	}
+
+	// jeden długi pobyt nie może rozmyć histogramu zwykłych
+	d := DwellDistribution(1, []int64{100, 120, 110, 500, 105, 100, 100})
+	if d.Visits != 7 || d.Samples != 7 || d.Total != 1135 || d.Mean != 1135.0/7 || d.Min != 100 || d.Max != 500 {
+		t.Errorf("stats: %+v", d)
+	}
+	if d.P50 != 105 || d.P90 != 500 || d.P95 != 500 || d.P99 != 500 {
+		t.Errorf("percentiles: P50 %d P90 %d P95 %d P99 %d", d.P50, d.P90, d.P95, d.P99)
+	}
+	var counts []int
+	for _, bin := range d.Histogram {
+		counts = append(counts, bin.Count)
+	}
+	if !reflect.DeepEqual(counts, []int{6, 0, 0, 0, 0, 0, 0, 0, 0, 1}) {
+		t.Errorf("histogram %v", counts)
+	}
+	if d.Histogram[0].From != d.Min || d.Histogram[len(d.Histogram)-1].To <= d.Max {
+		t.Errorf("histogram %+v does not cover %d..%d", d.Histogram, d.Min, d.Max)
+	}
+
+	// odchylenie standardowe próbki
+	if got := DwellDistribution(0, []int64{2, 4, 4, 4, 5, 5, 7, 9}).StdDev; math.Abs(got-math.Sqrt(32.0/7)) > 1e-9 {
+		t.Errorf("StdDev = %v", got)
+	}
+}
+
+// TestDwellSketch - Przy dłuższej pracy liczności i średnia zostają dokładne, próbka ograniczona
+// ================================================================================================
+func TestDwellSketch(t *testing.T) {
+	var d dwellSketch
+	n := 10 * dwellSamples
+	for i := 0; i < n; i++ {
+		d.Add(int64(i % 100))
+	}
+	ds := d.Stats(3)
+	if ds.State != 3 || ds.Visits != n || ds.Samples != dwellSamples || ds.Total != int64(n/100*4950) || ds.Min != 0 || ds.Max != 99 {
+		t.Errorf("Stats = %+v", ds)
+	}
+	if math.Abs(ds.Mean-49.5) > 1e-9 || math.Abs(ds.StdDev-math.Sqrt(float64(n)*833.25/float64(n-1))) > 1e-6 {
+		t.Errorf("Mean %v StdDev %v", ds.Mean, ds.StdDev)
+	}
+	count := 0
+	for _, bin := range ds.Histogram {
+		count += bin.Count
+	}
+	if count != dwellSamples {
+		t.Errorf("histogram of %d samples, want %d", count, dwellSamples)
+	}
+}
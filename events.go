@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sync"
+)
+
+// ilość zdarzeń oczekujących na odbiorcę - przy przepełnieniu zdarzenia są gubione
+const eventQueue = 256
+
+// Event - Zdarzenie z pętli odczytu PLC
+// Type: "image", "state", "transition", "cycle" (koniec cyklu), "cycles" (nowe czasy cykli), "anomaly",
+// "cpu" (zmiana RUN/STOP)
+// ========================================================
+type Event struct {
+	Session string           `json:"Session"`
+	Type    string           `json:"Type"`
+	Time    int64            `json:"Time"`
+	Image   *[imageSize]byte `json:"-"`
+	Data    interface{}      `json:"Data,omitempty"`
+}
+
+// TransitionEvent - Przejście między stanami wykryte na żywo
+// ========================================================
+type TransitionEvent struct {
+	Src         int   `json:"Src"`
+	Dst         int   `json:"Dst"`
+	Time        int64 `json:"Time"`
+	Uncertainty int64 `json:"Uncertainty"` // [ms] Time ± Uncertainty (95%)
+}
+
+// StateEvent - Zmiana stanu maszyny (-1 = stan nieznany)
+// ========================================================
+type StateEvent struct {
+	State int `json:"State"`
+}
+
+// CycleEvent - Zakończony cykl maszyny (powrót do stanu 0)
+// ========================================================
+type CycleEvent struct {
+	Time int64 `json:"Time"`
+}
+
+// AnomalyEvent - Odstępstwo od nauczonego modelu
+// Reason: "state" (nieznany stan), "transition" (nieznane przejście), "timing" (czas poza zakresem)
+// ========================================================
+type AnomalyEvent struct {
+	Reason  string `json:"Reason"`
+	Src     int    `json:"Src"`
+	Dst     int    `json:"Dst"`
+	Time    int64  `json:"Time"`
+	MinTime int64  `json:"MinTime,omitempty"`
+	MaxTime int64  `json:"MaxTime,omitempty"`
+}
+
+// eventSubscribers - Odbiorcy zdarzeń (WebSocket, MQTT, ...)
+// ========================================================
+var eventSubscribers = map[int]chan Event{}
+var eventSubscriberID int
+var eventMutex sync.Mutex
+
+// SubscribeEvents - Rejestracja odbiorcy zdarzeń
+// ================================================================================================
+func SubscribeEvents() (int, <-chan Event) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	eventSubscriberID++
+	ch := make(chan Event, eventQueue)
+	eventSubscribers[eventSubscriberID] = ch
+	return eventSubscriberID, ch
+}
+
+// UnsubscribeEvents - Wyrejestrowanie odbiorcy zdarzeń
+// ================================================================================================
+func UnsubscribeEvents(id int) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	if ch, ok := eventSubscribers[id]; ok {
+		close(ch)
+		delete(eventSubscribers, id)
+	}
+}
+
+// PublishEvent - Rozesłanie zdarzenia (bez czekania na wolnych odbiorców)
+// ================================================================================================
+func PublishEvent(e Event) {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	for _, ch := range eventSubscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// liveTracker - Śledzenie stanu maszyny na żywo względem nauczonego modelu
+// ========================================================
+type liveTracker struct {
+	session string
+	state   int
+	since   int64
+	cycles  int
+	cycle   int64 // ostatnie wejście w stan 0 (początek cyklu)
+}
+
+// newLiveTracker - Śledzenie stanu dla sesji (połączenia z PLC)
+// ================================================================================================
+func newLiveTracker(session string) *liveTracker {
+	return &liveTracker{session: session, state: -1}
+}
+
+// Reset - Po powrocie CPU do RUN stan sprzed STOP nie jest początkiem przejścia ani cyklu
+// ================================================================================================
+func (t *liveTracker) Reset() {
+	t.state, t.since, t.cycle = -1, 0, 0
+	SetLiveState(-1, 0)
+}
+
+// Track - Zdarzenia dla nowego obrazu z PLC
+// Przejścia i anomalie dopiero po znalezieniu cykli (etap AnalyzeWrite)
+// ================================================================================================
+func (t *liveTracker) Track(image MachineImage) {
+	buf := image.IOImage
+	PublishEvent(Event{Session: t.session, Type: "image", Time: image.Timestamp, Image: &buf})
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+	m := model
+	if len(m.cyclesFound) > t.cycles {
+		PublishEvent(Event{Session: t.session, Type: "cycles", Time: image.Timestamp, Data: append([]int64(nil), m.cyclesFound[t.cycles:]...)})
+		t.cycles = len(m.cyclesFound)
+	}
+	if etap != "AnalyzeWrite" || len(m.machineStates) == 0 {
+		return
+	}
+
+	state := m.FindState(MaskedState(image, m.maskImage).IOImage)
+	if state == t.state {
+		return
+	}
+	src, since := t.state, t.since
+	t.state, t.since = state, ImageTime(image)
+	SetLiveState(state, image.Timestamp)
+	metricMachineState.WithLabelValues(t.session).Set(float64(state))
+	PublishEvent(Event{Session: t.session, Type: "state", Time: image.Timestamp, Data: StateEvent{State: state}})
+	if state < 0 {
+		metricAnomalies.WithLabelValues(t.session, "state").Inc()
+		PublishEvent(Event{Session: t.session, Type: "anomaly", Time: image.Timestamp, Data: AnomalyEvent{Reason: "state", Src: src, Dst: -1}})
+		return
+	}
+	if state == 0 {
+		if t.cycle > 0 {
+			metricCycleTime.WithLabelValues(t.session).Set(float64(ImageTime(image)-t.cycle) / 1e9)
+			PublishEvent(Event{Session: t.session, Type: "cycle", Time: image.Timestamp, Data: CycleEvent{Time: (ImageTime(image) - t.cycle) / 1000000}})
+		}
+		t.cycle = ImageTime(image)
+	}
+	// pierwszy rozpoznany stan lub powrót z nieznanego - brak czasu przejścia
+	if src < 0 {
+		return
+	}
+
+	period := (ImageTime(image) - since) / 1000000
+	PublishEvent(Event{Session: t.session, Type: "transition", Time: image.Timestamp, Data: TransitionEvent{Src: src, Dst: state, Time: period, Uncertainty: SessionJitter().Uncertainty}})
+
+	if anomaly, ok := m.CheckTransition(src, state, period); !ok {
+		metricAnomalies.WithLabelValues(t.session, anomaly.Reason).Inc()
+		PublishEvent(Event{Session: t.session, Type: "anomaly", Time: image.Timestamp, Data: anomaly})
+	}
+}
+
+// CheckTransition - Czy przejście i jego czas zgadzają się z modelem
+// ================================================================================================
+func (m *Model) CheckTransition(src int, dst int, period int64) (AnomalyEvent, bool) {
+	anomaly := AnomalyEvent{Reason: "transition", Src: src, Dst: dst, Time: period}
+	known := false
+	for _, trans := range m.Transisions {
+		if trans.StateNrSrc != src || trans.StateNrDst != dst {
+			continue
+		}
+		if period > trans.Time-m.PeriodPrecision && period < trans.Time+m.PeriodPrecision {
+			return anomaly, true
+		}
+		if !known || trans.Time-m.PeriodPrecision < anomaly.MinTime {
+			anomaly.MinTime = trans.Time - m.PeriodPrecision
+		}
+		if !known || trans.Time+m.PeriodPrecision > anomaly.MaxTime {
+			anomaly.MaxTime = trans.Time + m.PeriodPrecision
+		}
+		known = true
+	}
+	if known {
+		anomaly.Reason = "timing"
+	}
+	return anomaly, false
+}
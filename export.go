@@ -0,0 +1,457 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/parquet-go/parquet-go"
+)
+
+// ilość wierszy w jednej grupie pliku Parquet - ogranicza zużycie pamięci przy dużych eksportach
+const exportRowGroup = 10000
+
+// exportColumn - Kolumna eksportowanej tabeli
+// Kind: "time", "int", "bool", "double", "string"
+// ========================================================
+type exportColumn struct {
+	Name string
+	Kind string
+}
+
+// tableWriter - Zapis tabeli wiersz po wierszu (CSV lub Parquet)
+// ========================================================
+type tableWriter interface {
+	Write(values []interface{}) error
+	Close() error
+}
+
+// csvTable - Tabela w formacie CSV
+// ========================================================
+type csvTable struct {
+	w   *csv.Writer
+	row []string
+}
+
+// parquetTable - Tabela w formacie Apache Parquet
+// ========================================================
+type parquetTable struct {
+	w       *parquet.Writer
+	columns []exportColumn
+	index   []int // numer kolumny w schemacie Parquet (kolumny są tam posortowane po nazwie)
+	row     parquet.Row
+}
+
+// Kolumny tabel stanów i przejść
+// ========================================================
+var stateColumns = []exportColumn{
+	{Name: "ID", Kind: "int"},
+	{Name: "Count", Kind: "int"},
+	{Name: "Hex", Kind: "string"},
+	{Name: "Bits", Kind: "string"},
+}
+var transitionColumns = []exportColumn{
+	{Name: "ID", Kind: "int"},
+	{Name: "Src", Kind: "int"},
+	{Name: "Dst", Kind: "int"},
+	{Name: "Time", Kind: "int"},
+	{Name: "Variants", Kind: "int"},
+	{Name: "MinTime", Kind: "int"},
+	{Name: "MaxTime", Kind: "int"},
+	{Name: "MeanTime", Kind: "double"},
+	{Name: "Precision", Kind: "int"},
+	{Name: "Uncertainty", Kind: "int"},
+}
+
+// CheckColumns - Sprawdzenie formatu i kolumn przed zapisem czegokolwiek
+// (Parquet nie pozwala na powtórzone nazwy kolumn)
+// ================================================================================================
+func CheckColumns(format string, columns []exportColumn) error {
+	switch format {
+	case "csv":
+		return nil
+	case "parquet":
+		names := make(map[string]bool, len(columns))
+		for _, col := range columns {
+			if names[col.Name] {
+				return errors.New("powtórzona kolumna " + col.Name)
+			}
+			names[col.Name] = true
+		}
+		return nil
+	}
+	return errors.New("nieznany format " + format + " (csv, parquet)")
+}
+
+// NewTableWriter - Zapis tabeli w wybranym formacie (csv, parquet)
+// ================================================================================================
+func NewTableWriter(out io.Writer, format string, name string, columns []exportColumn) (tableWriter, error) {
+	if err := CheckColumns(format, columns); err != nil {
+		return nil, err
+	}
+	if format == "csv" {
+		t := &csvTable{w: csv.NewWriter(out), row: make([]string, len(columns))}
+		for i, col := range columns {
+			t.row[i] = col.Name
+		}
+		return t, t.w.Write(t.row)
+	}
+
+	group := parquet.Group{}
+	for _, col := range columns {
+		group[col.Name] = parquetNode(col.Kind)
+	}
+	schema := parquet.NewSchema(name, group)
+	t := &parquetTable{
+		w:       parquet.NewWriter(out, schema, parquet.MaxRowsPerRowGroup(exportRowGroup), parquet.Compression(&parquet.Snappy)),
+		columns: columns,
+		index:   make([]int, len(columns)),
+		row:     make(parquet.Row, len(columns)),
+	}
+	for i, col := range columns {
+		leaf, _ := schema.Lookup(col.Name)
+		t.index[i] = leaf.ColumnIndex
+	}
+	return t, nil
+}
+
+// parquetNode - Typ kolumny Parquet
+// ================================================================================================
+func parquetNode(kind string) parquet.Node {
+	switch kind {
+	case "time":
+		return parquet.Timestamp(parquet.Nanosecond)
+	case "int":
+		return parquet.Optional(parquet.Int(64))
+	case "bool":
+		return parquet.Optional(parquet.Leaf(parquet.BooleanType))
+	case "double":
+		return parquet.Optional(parquet.Leaf(parquet.DoubleType))
+	}
+	return parquet.Optional(parquet.String())
+}
+
+// Write - Wiersz CSV
+// ================================================================================================
+func (t *csvTable) Write(values []interface{}) error {
+	for i, v := range values {
+		t.row[i] = FormatCell(v)
+	}
+	return t.w.Write(t.row)
+}
+
+// Close - Zakończenie pliku CSV
+// ================================================================================================
+func (t *csvTable) Close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+// Write - Wiersz Parquet
+// ================================================================================================
+func (t *parquetTable) Write(values []interface{}) error {
+	for i, v := range values {
+		col := t.index[i]
+		if t.columns[i].Kind == "time" {
+			t.row[col] = parquet.Int64Value(v.(int64)).Level(0, 0, col)
+			continue
+		}
+		value, ok := parquetValue(t.columns[i].Kind, v)
+		if !ok {
+			t.row[col] = parquet.NullValue().Level(0, 0, col)
+			continue
+		}
+		t.row[col] = value.Level(0, 1, col)
+	}
+	_, err := t.w.WriteRows([]parquet.Row{t.row})
+	return err
+}
+
+// Close - Zakończenie pliku Parquet (stopka ze schematem)
+// ================================================================================================
+func (t *parquetTable) Close() error {
+	return t.w.Close()
+}
+
+// parquetValue - Wartość komórki jako wartość Parquet (false gdy brak wartości)
+// ================================================================================================
+func parquetValue(kind string, v interface{}) (parquet.Value, bool) {
+	if v == nil {
+		return parquet.Value{}, false
+	}
+	switch kind {
+	case "bool":
+		b, ok := v.(bool)
+		return parquet.BooleanValue(b), ok
+	case "int", "double":
+		f, ok := numericValue(v)
+		if !ok {
+			return parquet.Value{}, false
+		}
+		if kind == "int" {
+			return parquet.Int64Value(int64(f)), true
+		}
+		return parquet.DoubleValue(f), true
+	}
+	return parquet.ByteArrayValue([]byte(FormatCell(v))), true
+}
+
+// numericValue - Wartość liczbowa komórki
+// ================================================================================================
+func numericValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case byte:
+		return float64(x), true
+	case uint16:
+		return float64(x), true
+	case int16:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+// FormatCell - Wartość komórki jako tekst (CSV, bity jako 0/1)
+// ================================================================================================
+func FormatCell(v interface{}) string {
+	if b, ok := v.(bool); ok {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	return FormatValue(v)
+}
+
+// signalKind - Typ kolumny dla sygnału
+// ================================================================================================
+func signalKind(s Signal) string {
+	if s.tag == nil {
+		if s.addr.Bit >= 0 {
+			return "bool"
+		}
+		return "int"
+	}
+	switch s.tag.Type {
+	case "BOOL":
+		return "bool"
+	case "REAL":
+		return "double"
+	case "CHAR", "STRING", "DT", "DTL":
+		return "string"
+	}
+	return "int"
+}
+
+// ImageBytes - Sygnały dla wszystkich bajtów obrazu (MB, EB, AB)
+// ================================================================================================
+func ImageBytes() []Signal {
+	signals := make([]Signal, 0, imageSize)
+	for index := 0; index < imageSize; index++ {
+		signals = append(signals, Signal{Name: FormatAddress(index, -1), addr: Address{Offset: index, Bit: -1, Size: 1}})
+	}
+	return signals
+}
+
+// timelineColumns - Kolumny eksportu timeline (Timestamp + kolumna dla każdego sygnału)
+// ================================================================================================
+func timelineColumns(signals []Signal) []exportColumn {
+	columns := []exportColumn{{Name: "Timestamp", Kind: "time"}}
+	for _, s := range signals {
+		columns = append(columns, exportColumn{Name: s.Name, Kind: signalKind(s)})
+	}
+	return columns
+}
+
+// ExportTimeline - Eksport timeline (Timestamp + kolumna dla każdego sygnału)
+// Obrazy są zapisywane kolejno z timeline, bez kopiowania wybranego przedziału
+// ================================================================================================
+func ExportTimeline(out io.Writer, format string, timeline []MachineImage, from int64, to int64, signals []Signal, changes bool) (int, error) {
+	columns := timelineColumns(signals)
+	t, err := NewTableWriter(out, format, "timeline", columns)
+	if err != nil {
+		return 0, err
+	}
+
+	rows := 0
+	values := make([]interface{}, len(columns))
+	for i, image := range timeline {
+		if image.Timestamp < from || image.Timestamp > to {
+			continue
+		}
+		if changes && rows > 0 && !Changed(signals, timeline[i-1].IOImage, image.IOImage) {
+			continue
+		}
+		values[0] = image.Timestamp
+		for k, s := range signals {
+			values[k+1] = s.Value(image.IOImage)
+		}
+		if err := t.Write(values); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	return rows, t.Close()
+}
+
+// ExportStates - Eksport tabeli stanów
+// ================================================================================================
+func ExportStates(out io.Writer, format string, m *Model) (int, error) {
+	t, err := NewTableWriter(out, format, "states", stateColumns)
+	if err != nil {
+		return 0, err
+	}
+	for k := range m.machineStates {
+		doc := m.StateDocument(k)
+		if err := t.Write([]interface{}{doc.ID, doc.Count, doc.Hex, strings.Join(doc.Bits, " ")}); err != nil {
+			return k, err
+		}
+	}
+	return len(m.machineStates), t.Close()
+}
+
+// ExportTransitions - Eksport tabeli przejść ze statystyką czasów
+// Min/Max/Mean liczone ze wszystkich wariantów czasowych danej krawędzi (Src -> Dst)
+// ================================================================================================
+func ExportTransitions(out io.Writer, format string, m *Model) (int, error) {
+	t, err := NewTableWriter(out, format, "transitions", transitionColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	type edgeStats struct {
+		count    int
+		min, max int64
+		sum      float64
+	}
+	edges := make(map[[2]int]*edgeStats)
+	for _, trans := range m.Transisions {
+		key := [2]int{trans.StateNrSrc, trans.StateNrDst}
+		e, ok := edges[key]
+		if !ok {
+			e = &edgeStats{min: math.MaxInt64, max: math.MinInt64}
+			edges[key] = e
+		}
+		e.count++
+		e.sum += float64(trans.Time)
+		if trans.Time < e.min {
+			e.min = trans.Time
+		}
+		if trans.Time > e.max {
+			e.max = trans.Time
+		}
+	}
+
+	for i, trans := range m.Transisions {
+		e := edges[[2]int{trans.StateNrSrc, trans.StateNrDst}]
+		if err := t.Write([]interface{}{i, trans.StateNrSrc, trans.StateNrDst, trans.Time,
+			e.count, e.min, e.max, e.sum / float64(e.count), m.PeriodPrecision, trans.Uncertainty}); err != nil {
+			return i, err
+		}
+	}
+	return len(m.Transisions), t.Close()
+}
+
+// exportStart - Nagłówki odpowiedzi z plikiem eksportu
+// Format i kolumny są sprawdzane przed wysłaniem statusu - błąd to jeszcze odpowiedź 400
+// ================================================================================================
+func exportStart(c *gin.Context, name string, columns []exportColumn) (string, bool) {
+	format := c.DefaultQuery("format", "csv")
+	if err := CheckColumns(format, columns); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	contentType := "text/csv"
+	if format == "parquet" {
+		contentType = "application/vnd.apache.parquet"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", "attachment; filename=s7-"+name+"-"+strconv.FormatInt(time.Now().Unix(), 10)+"."+format)
+	c.Status(http.StatusOK)
+	return format, true
+}
+
+// GetExportTimeline - Eksport timeline (format, from, to, signals, changes)
+// Bez listy sygnałów eksportowane są wszystkie bajty obrazu
+// ================================================================================================
+func GetExportTimeline(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetExportTimeline()")
+
+	from, err := ParseTimeParam(c.Query("from"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseTimeParam(c.Query("to"), math.MaxInt64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	signals, err := ParseSignals(c.Query("signals"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(signals) == 0 {
+		signals = ImageBytes()
+	}
+	changes := c.Query("changes") == "1" || c.Query("changes") == "true"
+
+	format, ok := exportStart(c, "timeline", timelineColumns(signals))
+	if !ok {
+		return
+	}
+	_, err = ExportTimeline(c.Writer, format, machineTimeline, from, to, signals, changes)
+	ErrCheck(err)
+}
+
+// GetExportStates - Eksport tabeli stanów (format)
+// ================================================================================================
+func GetExportStates(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetExportStates()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	format, ok := exportStart(c, "states", stateColumns)
+	if !ok {
+		return
+	}
+	_, err := ExportStates(c.Writer, format, model)
+	ErrCheck(err)
+}
+
+// GetExportTransitions - Eksport tabeli przejść (format)
+// ================================================================================================
+func GetExportTransitions(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetExportTransitions()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	format, ok := exportStart(c, "transitions", transitionColumns)
+	if !ok {
+		return
+	}
+	_, err := ExportTransitions(c.Writer, format, model)
+	ErrCheck(err)
+}
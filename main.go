@@ -3,11 +3,14 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/sse"
@@ -15,36 +18,44 @@ import (
 	"github.com/robinson/gos7"
 )
 
-const cyclesAnalyzeTime = 30
-const cyclesAnalyzeTimeAdd = 15
 const imageSize = 128 * 3
 
-// const minCycleTime = 10000
-const minCycleTime = 2000
+// maxReadErrors - Ilość kolejnych błędów odczytu, po której zamykamy połączenie z PLC
+const maxReadErrors = 10
+
+// parametry analizy - wartości z konfiguracji (config.go)
+var cyclesAnalyzeTime = 30
+var cyclesAnalyzeTimeAdd = 15
+var minCycleTime int64 = 2000
 
 var plcAddress string
 var plcConnected bool
 var etap string
-var comparePrecision int
-var firstCycle bool
 var cyclesTime int
-var periodPrecision int64
 var startingPrecision int
 
 // MachineImage - Rekord danych
 // ========================================================
+// Timestamp - środek odczytu (ReadStart..ReadEnd), najlepsze przybliżenie chwili obrazu
+// PLCTime, PLCCounter - znacznik z programu PLC (gdy skonfigurowany zegar PLC)
+// ========================================================
 type MachineImage struct {
-	Timestamp int64           `json:"Timestamp"`
-	IOImage   [imageSize]byte `json:"IOImage"`
+	Timestamp  int64           `json:"Timestamp"`
+	ReadStart  int64           `json:"ReadStart,omitempty"`
+	ReadEnd    int64           `json:"ReadEnd,omitempty"`
+	PLCTime    int64           `json:"PLCTime,omitempty"`
+	PLCCounter int64           `json:"PLCCounter,omitempty"`
+	IOImage    [imageSize]byte `json:"IOImage"`
 }
 
 // Transision - Przejście między stanami
 // Numer stanu z tablicy machineStates
 // ========================================================
 type Transision struct {
-	StateNrSrc int   `json:"StateNrSrc"`
-	StateNrDst int   `json:"StateNrDst"`
-	Time       int64 `json:"Time"`
+	StateNrSrc  int   `json:"StateNrSrc"`
+	StateNrDst  int   `json:"StateNrDst"`
+	Time        int64 `json:"Time"`
+	Uncertainty int64 `json:"Uncertainty"` // [ms] Time ± Uncertainty (95%) z jittera próbkowania
 }
 
 // Statistics - dane statystyczne
@@ -53,59 +64,25 @@ type Statistics struct {
 	Trans  []Transision      `json:"Trans"`
 	Stats  []int             `json:"Stats"`
 	States [][imageSize]byte `json:"States"`
+	Analog [][]AnalogRange   `json:"Analog"`
 }
 
 // statistics - dane statystyczne
 // ========================================================
 var statistics Statistics
 
-// Transisions - Tablica przejść między stanami
-// ========================================================
-var Transisions []Transision
-
 // machineTimeline - Dane
 // ========================================================
 var machineTimeline []MachineImage
 
-// machineStates - Dane
-// ========================================================
-var machineStates [][imageSize]byte
-
-// cyclesFound - Znalezione cykle
-// ========================================================
-var cyclesFound []int64
-
-// cyclesNrsFound - Numery obrazów które posłużyły za znalezienie cykli
-// ========================================================
-var cyclesNrsFound []int64
-
-// maskImage - Maska obrazu - wybrane bajty nie są brane pod uwage przy rejestracji stanów maszyny
-// ========================================================
-var maskImage [imageSize]byte
-
-// statesStatistics - Ile razy występuje stan z machinestates w timeline
+// model - Aktualny model maszyny uczony na żywo
 // ========================================================
-var statesStatistics []int
+var model *Model
 
-// machineStates - Dane
+// modelMutex - Dostęp do model, candidateModel i rebuildRunning
+// Pętla analizy rozbudowuje model pod blokadą zapisu, handlery czytają pod blokadą odczytu
 // ========================================================
-var machineStatesNr int
-
-// transisionNr - Dane
-// ========================================================
-var transisionNr int
-
-// writeID - ostatnio anlizowany obraz w funkcji Write
-// ========================================================
-var writeID int
-
-// stateNr - ostatnio anlizowany obraz w funkcji AnalyzeStatistics
-// ========================================================
-var stateNr int
-
-// transID - ostatnio anlizowany obraz w funkcji Transisions
-// ========================================================
-var transID int
+var modelMutex sync.RWMutex
 
 // valuesRange - Analiza zmienności danych
 // ========================================================
@@ -167,7 +144,7 @@ func MaskedImageEqual(imSrc [imageSize]byte, imMask [imageSize]byte) bool {
 
 	cnt := 0
 	for i := 0; i < imageSize; i++ {
-		if imSrc[i] != (imMask[i] & maskImage[i]) {
+		if imSrc[i] != (imMask[i] & model.maskImage[i]) {
 			cnt++
 		}
 	}
@@ -227,7 +204,7 @@ func ConnectionTime() int {
 
 // AnalyzeCycles - szukamy maksymalnego procenta wzrorca (największego obrazu który daje pattern)
 // ================================================================================================
-func AnalyzeCycles() {
+func (m *Model) AnalyzeCycles(timeline []MachineImage) {
 	var patternFound bool
 	var patternIndex1 int
 	var patternIndex2 int
@@ -236,22 +213,29 @@ func AnalyzeCycles() {
 	var addCycle bool
 	var cycleNrFound bool
 
-	nrOfImages := len(machineTimeline)
+	nrOfImages := len(timeline)
 	nrOfCyclesFound := 0
 
-	for i, image1 := range machineTimeline {
+	// porównujemy tylko sygnały dyskretne - sygnały ciągłe czynią każdy obraz unikalnym
+	m.UpdateBitStats(timeline)
+	m.ClassifySignals()
+	// ręczne zmiany maski także przy szukaniu cykli (np. wykluczony licznik)
+	digitalMask := ApplyOverrides(m.DigitalMask())
+
+	for i, image1 := range timeline {
 		if i > 0 { // nie sprawdzamy obrazu pod indexem 0
-			if !ImageEqual(image1, machineTimeline[i-1]) { // sprawdamy czy nastąpiła zmiana obrazu
+			if !ImageEqual(image1, timeline[i-1]) { // sprawdamy czy nastąpiła zmiana obrazu
 				for j := 0; j < i; j++ {
-					image2 := machineTimeline[j]
+					image2 := timeline[j]
 
-					comp := ImageCompare(image1.IOImage, image2.IOImage)
-					if comp <= comparePrecision {
+					comp := ImageCompare(MaskedImage(image1.IOImage, digitalMask), MaskedImage(image2.IOImage, digitalMask))
+					// obrazy rozdzielone przez STOP CPU nie wyznaczają czasu cyklu
+					if comp <= m.ComparePrecision && !m.StopBetween(image2.Timestamp, image1.Timestamp) {
 
 						patternIndex1 = i
 						patternIndex2 = j
-						patternTimestamp1 = image1.Timestamp
-						patternTimestamp2 = image2.Timestamp
+						patternTimestamp1 = ImageTime(image1)
+						patternTimestamp2 = ImageTime(image2)
 						// Drukuj jeżeli znaleźliśmy pattern powyżej 1000ms
 						// Uwzględniamy tolerancję +/-500ms więc sprawdzamy w liście czy już takiego nie ma
 						// Dodajemy do listy patternów
@@ -259,13 +243,13 @@ func AnalyzeCycles() {
 						newCycle := (patternTimestamp1 - patternTimestamp2) / 1000000 // milliseconds
 						// log.Println("New cycle = " + strconv.FormatInt(newCycle, 10))
 						addCycle = true
-						for _, cycle := range cyclesFound {
-							if (newCycle < (cycle + periodPrecision)) && (newCycle > (cycle - periodPrecision)) {
+						for _, cycle := range m.cyclesFound {
+							if (newCycle < (cycle + m.PeriodPrecision)) && (newCycle > (cycle - m.PeriodPrecision)) {
 								addCycle = false
 							}
 						}
 						cycleNrFound = true
-						for _, nr := range cyclesNrsFound {
+						for _, nr := range m.cyclesNrsFound {
 							if nr == int64(j) {
 								cycleNrFound = false
 								break
@@ -274,8 +258,8 @@ func AnalyzeCycles() {
 
 						if addCycle && cycleNrFound && newCycle > minCycleTime {
 							patternFound = true
-							cyclesFound = append(cyclesFound, newCycle)
-							cyclesNrsFound = append(cyclesNrsFound, int64(j))
+							m.cyclesFound = append(m.cyclesFound, newCycle)
+							m.cyclesNrsFound = append(m.cyclesNrsFound, int64(j))
 
 							log.Println("Pattern found (" +
 								strconv.Itoa(comp) + " bytes precision) with duration " +
@@ -284,14 +268,14 @@ func AnalyzeCycles() {
 								strconv.Itoa(patternIndex2) + "]")
 
 							log.Println("images nrs for cycles:")
-							log.Println(cyclesNrsFound)
+							log.Println(m.cyclesNrsFound)
 
 							// gdy jest to pierwszy napotkany wzorzec zapisujemy maskę
-							if nrOfCyclesFound == 0 && !firstCycle {
-								maskImage = ImageDiff(image1, image2.IOImage)
-								firstCycle = true
+							if nrOfCyclesFound == 0 && !m.firstCycle {
+								m.maskImage = MaskedImage(ImageDiff(image1, image2.IOImage), digitalMask)
+								m.firstCycle = true
 								log.Println("Mask image:")
-								log.Println(maskImage)
+								log.Println(m.maskImage)
 							}
 
 							// log.Println("image1:")
@@ -312,87 +296,88 @@ func AnalyzeCycles() {
 	}
 
 	if !patternFound {
-		log.Println("Pattern not found in " + strconv.Itoa(nrOfImages) + " machine states records, precision = " + strconv.Itoa(comparePrecision))
+		log.Println("Pattern not found in " + strconv.Itoa(nrOfImages) + " machine states records, precision = " + strconv.Itoa(m.ComparePrecision))
 		// log.Println("Mask image:")
-		// log.Println(maskImage)
+		// log.Println(m.maskImage)
 	} else {
 		log.Println("Pattern found in " + strconv.Itoa(nrOfImages) + " machine states records")
 		if addCycle {
 			log.Println("Cycles list:")
-			log.Println(cyclesFound)
+			log.Println(m.cyclesFound)
 		}
 		// log.Println("Mask image:")
-		// log.Println(maskImage)
+		// log.Println(m.maskImage)
 	}
 }
 
 // AnalyzeWrite - zapis tylko nowych obrazów
 // ================================================================================================
-func AnalyzeWrite() {
+func (m *Model) AnalyzeWrite(timeline []MachineImage) {
 
 	// var maskedImage [imageSize]byte
 
-	length := len(machineTimeline)
-	for i := writeID; i < length; i++ {
+	length := len(timeline)
+	for i := m.writeID; i < length; i++ {
 		// maskujemy obraz
-		maskedImage := MaskedImage(machineTimeline[i].IOImage, maskImage)
+		maskedImage := MaskedImage(timeline[i].IOImage, m.maskImage)
 		// sprawdzamy czy już taki mamy
 		newImage := true
-		for _, image2 := range machineStates {
+		for _, image2 := range m.machineStates {
 			if ImageCompare(maskedImage, image2) == 0 {
 				newImage = false
 				break
 			}
 		}
-		// jeżeli nowy i nie zerowy
-		if newImage && !ImageZero(maskedImage) {
+		// jeżeli nowy - zerowy obraz (np. maszyna w spoczynku lub na wyłączniku bezpieczeństwa) to też stan
+		if newImage {
 			// dodajemy do listy stanów
-			machineStates = append(machineStates, maskedImage)
+			m.machineStates = append(m.machineStates, maskedImage)
 			// dodajemy również do statystyk
-			statesStatistics = append(statesStatistics, 0)
-			machineStatesNr++
-			// log.Println("New image registered nr " + strconv.Itoa(len(machineStates)))
+			m.statesStatistics = append(m.statesStatistics, 0)
+			// log.Println("New image registered nr " + strconv.Itoa(len(m.machineStates)))
 			// log.Println(maskedImage)
 		}
 	}
-	writeID = length
-	log.Println(machineStatesNr, "images registered")
+	m.writeID = length
+	log.Println(len(m.machineStates), "images registered")
 }
 
 // AnalyzeStatistics - update ilości występowania state w transisions
 // ================================================================================================
-func AnalyzeStatistics() {
-
-	length := len(machineTimeline) - 1
-	for _, trans := range Transisions {
-		for j := stateNr; j < length; j++ {
-			image1 := MaskedState(machineTimeline[j], maskImage)
-			image2 := MaskedState(machineTimeline[j+1], maskImage)
-
-			if ImageCompare(machineStates[trans.StateNrSrc], image1.IOImage) == 0 &&
-				ImageCompare(machineStates[trans.StateNrDst], image2.IOImage) == 0 {
-				statesStatistics[trans.StateNrSrc]++
-				statesStatistics[trans.StateNrDst]++
+func (m *Model) AnalyzeStatistics(timeline []MachineImage) {
+
+	length := len(timeline) - 1
+	for _, trans := range m.Transisions {
+		for j := m.stateNr; j < length; j++ {
+			image1 := MaskedState(timeline[j], m.maskImage)
+			image2 := MaskedState(timeline[j+1], m.maskImage)
+
+			if ImageCompare(m.machineStates[trans.StateNrSrc], image1.IOImage) == 0 &&
+				ImageCompare(m.machineStates[trans.StateNrDst], image2.IOImage) == 0 {
+				m.statesStatistics[trans.StateNrSrc]++
+				m.statesStatistics[trans.StateNrDst]++
 			}
 		}
 	}
-	stateNr = length
-	// log.Println("States statistics ", statesStatistics)
+	m.stateNr = length
+	// log.Println("States statistics ", m.statesStatistics)
 }
 
 // AnalyzeTransitions - zapis przejść
 // ================================================================================================
-func AnalyzeTransitions() {
+func (m *Model) AnalyzeTransitions(timeline []MachineImage) {
 
-	length := len(machineTimeline) - 2
+	length := len(timeline) - 2
+	m.UpdateJitter(timeline)
+	uncertainty := m.jitter.Uncertainty()
 
-	for i := transID; i < length; i++ {
+	for i := m.transID; i < length; i++ {
 
 		// pobierz obrazy z timeline
 		// działamy na obrazach zamaskowanych
 
-		image0 := MaskedState(machineTimeline[i], maskImage)
-		imageSrc := MaskedState(machineTimeline[i+1], maskImage)
+		image0 := MaskedState(timeline[i], m.maskImage)
+		imageSrc := MaskedState(timeline[i+1], m.maskImage)
 
 		// szukanie pierwszej zmiany stanu
 		if !ImageEqual(image0, imageSrc) {
@@ -401,8 +386,8 @@ func AnalyzeTransitions() {
 			for i := i; i < length; i++ {
 
 				// pobierz obrazy z timeline
-				image1 := MaskedState(machineTimeline[i+1], maskImage)
-				imageDst := MaskedState(machineTimeline[i+2], maskImage)
+				image1 := MaskedState(timeline[i+1], m.maskImage)
+				imageDst := MaskedState(timeline[i+2], m.maskImage)
 
 				// kolejna zmiana stanu
 				if !ImageEqual(image1, imageDst) {
@@ -411,42 +396,43 @@ func AnalyzeTransitions() {
 					var dstIndex int
 
 					// szkamy numerów stanów w tablicy stanów
-					for k, state := range machineStates {
+					for k, state := range m.machineStates {
 						if ImageCompare(state, imageSrc.IOImage) == 0 {
 							srcIndex = k
 							break
 						}
 					}
-					for k, state := range machineStates {
+					for k, state := range m.machineStates {
 						if ImageCompare(state, imageDst.IOImage) == 0 {
 							dstIndex = k
 							break
 						}
 					}
 
-					if srcIndex != dstIndex {
+					// przejście przez STOP CPU to nie zachowanie maszyny
+					if srcIndex != dstIndex && !m.StopBetween(imageSrc.Timestamp, imageDst.Timestamp) {
 
-						period1 := (imageDst.Timestamp - imageSrc.Timestamp) / 1000000
+						period1 := (ImageTime(imageDst) - ImageTime(imageSrc)) / 1000000
 
 						// sprawdzamy czy jest taka kompinacja w transitions
 
 						newTrans := true
-						for _, trans := range Transisions {
+						for _, trans := range m.Transisions {
 							period2 := trans.Time
-							if trans.StateNrSrc == srcIndex && trans.StateNrDst == dstIndex && period1 > period2-periodPrecision && period1 < period2+periodPrecision {
+							if trans.StateNrSrc == srcIndex && trans.StateNrDst == dstIndex && period1 > period2-m.PeriodPrecision && period1 < period2+m.PeriodPrecision {
 								newTrans = false
 								break
 							}
 						}
 						if newTrans {
-							Transisions = append(Transisions,
+							m.Transisions = append(m.Transisions,
 								Transision{
-									StateNrSrc: srcIndex,
-									StateNrDst: dstIndex,
-									Time:       period1,
+									StateNrSrc:  srcIndex,
+									StateNrDst:  dstIndex,
+									Time:        period1,
+									Uncertainty: uncertainty,
 								})
 							// log.Println("New transision registered from", srcIndex, "to", dstIndex, "with period", period1)
-							transisionNr++
 						}
 					}
 					// koniec - nie szukamy kolejnych zmian
@@ -455,8 +441,8 @@ func AnalyzeTransitions() {
 			}
 		}
 	}
-	transID = length
-	log.Println(transisionNr, "transitions registered")
+	m.transID = length
+	log.Println(len(m.Transisions), "transitions registered")
 }
 
 //
@@ -471,27 +457,37 @@ func AnalyzeTransitions() {
 func ScanTimeline() {
 
 	for {
-		if plcConnected {
+		if plcConnected && CPUStopped() {
+			// CPU w STOP - nie uczymy się z wyzerowanych wyjść, czas STOP nie liczy się do szukania cykli
+			log.Println("CPU STOP - analiza wstrzymana")
+			time.Sleep(5000 * time.Millisecond)
+		} else if plcConnected {
+			stage := etap
+			analysisStart := time.Now()
 			switch etap {
 
 			case "AnalyzeCycles":
-				AnalyzeCycles()
+				modelMutex.Lock()
+				m := model
+				m.AnalyzeCycles(machineTimeline)
 				if ConnectionTime() >= cyclesTime {
-					if len(cyclesFound) == 0 {
-						log.Println("Didn't found any cycles with precision " + strconv.Itoa(comparePrecision))
-						comparePrecision++
+					if len(m.cyclesFound) == 0 {
+						log.Println("Didn't found any cycles with precision " + strconv.Itoa(m.ComparePrecision))
+						m.ComparePrecision++
 						cyclesTime += cyclesAnalyzeTimeAdd
-						log.Println("Decreasing precision to " + strconv.Itoa(comparePrecision) + " bytes")
+						log.Println("Decreasing precision to " + strconv.Itoa(m.ComparePrecision) + " bytes")
 					} else {
+						m.AnalyzeMask(machineTimeline)
 						etap = "AnalyzeWrite"
 						log.Println("AnalyzeCycles -> AnalyzeWrite...")
 					}
 				}
+				modelMutex.Unlock()
 			case "AnalyzeWrite":
 				// AnalyzeCycles()
-				AnalyzeWrite()
-				AnalyzeTransitions()
-				AnalyzeStatistics()
+				modelMutex.Lock()
+				model.AnalyzeModel(machineTimeline)
+				modelMutex.Unlock()
 			default:
 				conectionTimeStart = int(time.Now().Unix())
 				if plcConnected {
@@ -499,6 +495,9 @@ func ScanTimeline() {
 					log.Println("default -> AnalyzeCycles...")
 				}
 			}
+			modelMutex.RLock()
+			MetricsAnalysis(plcAddress, stage, time.Since(analysisStart), model)
+			modelMutex.RUnlock()
 			time.Sleep(5000 * time.Millisecond)
 
 			log.Println(etap, "time", ConnectionTime(), "/", cyclesTime, "of", len(machineTimeline))
@@ -514,25 +513,24 @@ func ScanTimeline() {
 // InitVars - reset tablic i stanów
 // ================================================================================================
 func InitVars() {
+	modelMutex.Lock()
+	model = NewModel(startingPrecision, config.Analysis.PeriodPrecision)
+	model.Source = "live"
+	// przebudowany model z poprzedniego połączenia nie pasuje do nowego timeline
+	if candidateModel != nil && candidateModel.Source == "live" {
+		candidateModel = nil
+	}
+	modelMutex.Unlock()
 	machineTimeline = nil
-	machineStates = nil
-	cyclesFound = nil
-	cyclesNrsFound = nil
-	Transisions = nil
-	statesStatistics = nil
 	statistics.States = nil
 	statistics.Stats = nil
 	statistics.Trans = nil
-	machineStatesNr = 0
-	transisionNr = 0
-	writeID = 0
-	transID = 0
-	stateNr = 0
-	firstCycle = false
-	comparePrecision = startingPrecision
+	statistics.Analog = nil
 	cyclesTime = cyclesAnalyzeTime
-	periodPrecision = 100
 	etap = "waiting"
+	ResetCPUState()
+	SetLiveState(-1, 0)
+	ResetJitter()
 }
 
 // base64Encode
@@ -584,11 +582,16 @@ func SendData(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	log.Println("SendData()")
 
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
 	// log.Println(machineTimeline[0].Timestamp)
 
-	statistics.States = machineStates
-	statistics.Stats = statesStatistics
-	statistics.Trans = Transisions
+	m := model
+	statistics.States = m.machineStates
+	statistics.Stats = m.statesStatistics
+	statistics.Trans = m.Transisions
+	statistics.Analog = m.statesAnalog
 	data, _ := json.MarshalIndent(statistics, "", "  ")
 
 	// log.Println(string(data))
@@ -615,9 +618,20 @@ func SendData(c *gin.Context) {
 func eventHandler(c *gin.Context) {
 	// func eventHandler(w http.ResponseWriter, req *http.Request) {
 
-	plcAddress := c.Query("plc_address")
-	slotNr, _ := strconv.Atoi(c.Query("slot_nr"))
-	startingPrecision, _ = strconv.Atoi(c.Query("precision"))
+	// parametry PLC z konfiguracji (plc = nazwa lub plc_address), query string je nadpisuje
+	plc, plcErr := PLCFromQuery(c)
+	plcAddress = plc.Address
+	startingPrecision = config.Analysis.ComparePrecision
+	if precision := c.Query("precision"); precision != "" {
+		startingPrecision, _ = strconv.Atoi(precision)
+	}
+
+	// interwały strumienia i tryb wysyłania obrazów dla tej sesji
+	stream, err := ParseStreamConfig(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	InitVars()
 
@@ -627,19 +641,16 @@ func eventHandler(c *gin.Context) {
 		}
 	}
 
-	if net.ParseIP(plcAddress) != nil {
+	if plcErr == nil {
 		log.Println("Odbebrałem adres IP: " + plcAddress)
 
 		// TCPClient
-		handler := gos7.NewTCPClientHandler(plcAddress, 0, slotNr)
-		handler.Timeout = 5 * time.Second
-		handler.IdleTimeout = 5 * time.Second
-		handler.PDULength = 960
-
 		// handler.Logger = log.New(os.Stdout, plcAddress+" : ", log.LstdFlags)
 
 		// Connect manually so that multiple requests are handled in one connection session
-		ret := handler.Connect()
+		handler, attempt, ret := ConnectPLC(plc)
+		lastConnection = &attempt
+		log.Println("Połączenie", attempt.ConnectionType, "rack", attempt.Rack, "slot", attempt.Slot, "TSAP", attempt.LocalTSAP, "->", attempt.RemoteTSAP)
 		defer handler.Close()
 		// log.Println(ret)
 		client := gos7.NewClient(handler)
@@ -648,6 +659,12 @@ func eventHandler(c *gin.Context) {
 		log.Println("Wynegocjowany PDU length =", handler.PDULength)
 
 		if ErrCheck(ret) {
+			// identyfikacja sterownika zapisywana z sesją (endpoint /api/v1/plc/:id/info i nagrania)
+			info := ReadPLCInfo(handler, plc)
+			StorePLCInfo(info)
+			log.Println("PLC", info.OrderCode, info.Firmware, info.ModuleTypeName, "stan", info.CPUState)
+			SetCPUState(plcAddress, info.CPUState, time.Now().UnixNano())
+
 			plcConnected = true
 			defer func() {
 				plcConnected = false
@@ -656,6 +673,13 @@ func eventHandler(c *gin.Context) {
 			bufMB := make([]byte, 128)
 			bufEB := make([]byte, 128)
 			bufAB := make([]byte, 128)
+			var bufClock []byte
+			clock := StartPLCClock(plcAddress, plc.Clock)
+			if plc.Clock != nil {
+				bufClock = make([]byte, plc.Clock.Size())
+			}
+			ring := StartRingReader(plcAddress, plc.Buffer)
+			var buf [imageSize]byte
 
 			// Typ połączania
 			c.Header("Access-Control-Allow-Origin", "*")
@@ -680,7 +704,11 @@ func eventHandler(c *gin.Context) {
 			log.Println("LOOP start for PLC IP " + plcAddress + " ...")
 
 			var ix int
-			lastTime := time.Now().UnixNano()
+			var readErrors int
+			tracker := newLiveTracker(plcAddress)
+			scheduler := pollScheduler{period: stream.PollInterval}
+			cpu := cpuMonitor{session: plcAddress, interval: plc.StatusInterval, last: time.Now().UnixNano()}
+			pusher := dataPusher{cfg: stream}
 			lastTime2 := time.Now().UnixNano()
 			lastTime3 := time.Now().UnixNano()
 
@@ -692,177 +720,258 @@ func eventHandler(c *gin.Context) {
 					break
 				}
 
-				// Odczyt sygnałów z PLC
+				// Odczyt sygnałów z PLC ze stałą częstotliwością (PollInterval od początku do początku odczytu)
+				scheduler.Wait()
 				readTimeStart := time.Now().UnixNano()
+				var readErr error
+				var images []MachineImage
 
+				// Z buforem zdarzeń PLC czytamy tylko nowe wpisy (każda zmiana ze znacznikiem czasu z PLC)
 				// Jeżeli PDU Length większy/równy od rozmiaru obrazu to odczytujemy wszystko razem
-				if handler.PDULength >= imageSize {
-					var error1, error2, error3 string
-
-					var items = []gos7.S7DataItem{
-						gos7.S7DataItem{
+				// Czytamy tylko obszary z konfiguracji PLC
+				if ring != nil {
+					images, readErr = ring.Read(client, readTimeStart)
+					ErrCheck(readErr)
+
+				} else if handler.PDULength >= imageSize+len(bufClock) {
+					var items []gos7.S7DataItem
+					if plc.ReadsArea("E") {
+						items = append(items, gos7.S7DataItem{
 							Area:    0x81,
 							WordLen: 0x02,
 							Start:   0,
 							Amount:  128,
 							Data:    bufEB,
-							Error:   error1,
-						},
-						gos7.S7DataItem{
+						})
+					}
+					if plc.ReadsArea("A") {
+						items = append(items, gos7.S7DataItem{
 							Area:    0x82,
 							WordLen: 0x02,
 							Start:   0,
 							Amount:  128,
 							Data:    bufAB,
-							Error:   error2,
-						},
-						gos7.S7DataItem{
+						})
+					}
+					if plc.ReadsArea("M") {
+						items = append(items, gos7.S7DataItem{
 							Area:    0x83,
 							WordLen: 0x02,
 							Start:   0,
 							Amount:  128,
 							Data:    bufMB,
-							Error:   error3,
-						},
+						})
+					}
+					if plc.Clock != nil {
+						// znacznik PLC w tym samym żądaniu - z tego samego cyklu PLC co obraz
+						items = append(items, gos7.S7DataItem{
+							Area:     0x84,
+							WordLen:  0x02,
+							DBNumber: plc.Clock.DB,
+							Start:    plc.Clock.Offset,
+							Amount:   len(bufClock),
+							Data:     bufClock,
+						})
+					}
+					readErr = client.AGReadMulti(items, len(items))
+					// błąd pojedynczego obszaru (np. brak dostępu) jest tylko w S7DataItem.Error
+					for _, item := range items {
+						if readErr == nil && item.Error != "" {
+							readErr = errors.New(item.Error)
+						}
 					}
-					err := client.AGReadMulti(items, 3)
-					ErrCheck(err)
+					ErrCheck(readErr)
 
 				} else {
-					client.AGReadMB(0, 128, bufMB)
-					client.AGReadEB(0, 128, bufEB)
-					client.AGReadAB(0, 128, bufAB)
+					var errs []error
+					if plc.ReadsArea("M") {
+						errs = append(errs, client.AGReadMB(0, 128, bufMB))
+					}
+					if plc.ReadsArea("E") {
+						errs = append(errs, client.AGReadEB(0, 128, bufEB))
+					}
+					if plc.ReadsArea("A") {
+						errs = append(errs, client.AGReadAB(0, 128, bufAB))
+					}
+					if plc.Clock != nil {
+						errs = append(errs, client.AGReadDB(plc.Clock.DB, plc.Clock.Offset, len(bufClock), bufClock))
+					}
+					for _, err := range errs {
+						if err != nil {
+							readErr = err
+						}
+					}
 				}
 
 				readTimeEnd := time.Now().UnixNano()
+				MetricsRead(plcAddress, time.Duration(readTimeEnd-readTimeStart), readErr)
 
 				if bufMB == nil || bufEB == nil || bufAB == nil {
 					log.Println("NIL...")
 					break
 				}
 
-				var buf [imageSize]byte
-				for index := range bufMB {
-					buf[index+128*0] = bufMB[index]
-				}
-				for index := range bufEB {
-					buf[index+128*1] = bufEB[index]
+				// Błąd odczytu to nie obraz maszyny - pomijamy go (zerowy obraz bez błędu jest poprawny)
+				if readErr != nil {
+					readErrors++
+					if readErrors >= maxReadErrors {
+						log.Println("Problem z odczytem z " + plcAddress + ": " + readErr.Error())
+						plcConnected = false
+					}
+					continue
 				}
-				for index := range bufEB {
-					buf[index+128*2] = bufAB[index]
+				readErrors = 0
+
+				if ring == nil {
+					for index := range bufMB {
+						buf[index+128*0] = bufMB[index]
+					}
+					for index := range bufEB {
+						buf[index+128*1] = bufEB[index]
+					}
+					for index := range bufEB {
+						buf[index+128*2] = bufAB[index]
+					}
+					image := MachineImage{Timestamp: readTimeStart + (readTimeEnd-readTimeStart)/2, ReadStart: readTimeStart, ReadEnd: readTimeEnd, IOImage: buf}
+					if clock != nil {
+						clock.Decode(bufClock, &image)
+					}
+					images = append(images, image)
+				} else if len(images) > 0 {
+					buf = images[len(images)-1].IOImage
 				}
 
-				// sprawdzamy czy same zera - jak tak to nie zapisujemy
-				emptyBuf := true
-				for i := range buf {
-					if buf[i] > 0 {
-						emptyBuf = false
+				// Stan CPU co StatusInterval - w STOP wyjścia są zerowane, więc obrazy nie opisują maszyny
+				// ==============================================
+
+				if change, ok := cpu.Poll(client, readTimeEnd); ok {
+					if change.State == "RUN" {
+						tracker.Reset()
+						BreakJitter()
+						if clock != nil {
+							clock.Break()
+						}
+						if ring != nil {
+							ring.Break()
+						}
 					}
+					sse.Encode(w, sse.Event{
+						Id:    plcAddress,
+						Event: "cpu",
+						Data:  change,
+					})
+					w.Flush()
+				}
+				stopped := CPUStopped()
+				if stopped {
+					images = nil
 				}
 
-				if emptyBuf {
-					log.Println("Pusty bufor!?")
-					plcConnected = false
-				} else {
+				for _, image := range images {
 
 					// Dodajemy do timeline
 					// ==============================================
 
-					machineTimeline = append(machineTimeline, MachineImage{Timestamp: readTimeEnd, IOImage: buf})
+					machineTimeline = append(machineTimeline, image)
+					TrackJitter(image, scheduler.overruns)
+
+					// Zdarzenia dla WebSocket (obraz, przejścia, anomalie, cykle)
+					// ==============================================
+
+					tracker.Track(image)
+					MetricsImage(plcAddress, len(machineTimeline))
 
 					// Dodajemy do valuesRange
 					// ==============================================
 
 					for cval := 0; cval < 256; cval++ {
 						for cindex := 0; cindex < imageSize; cindex++ {
-							if buf[cindex] == byte(cval) {
+							if image.IOImage[cindex] == byte(cval) {
 								if valuesRange[cval][cindex] < 255 {
 									valuesRange[cval][cindex]++
 								}
 							}
 						}
 					}
+				}
 
-					// Wysyłamy timeline do VISU co 500 ms (ekran PLC)
-					// ==============================================
-
-					dane := map[string]interface{}{
-						"time":    readTimeEnd,
-						"content": buf,
-					}
-
-					if readTimeEnd-lastTime > 500000000 {
-
-						sse.Encode(w, sse.Event{
-							Id:    plcAddress,
-							Event: "data",
-							Data:  dane,
-						})
-						// Wysłanie i poczekanie
-						w.Flush()
-
-						// log.Println(plcAddress + " Wysłano: " + strconv.FormatInt(timestamp, 10))
+				// Wysyłamy timeline do VISU co DataInterval lub po zmianie (ekran PLC)
+				// ==============================================
 
-						lastTime = time.Now().UnixNano()
+				dane := map[string]interface{}{
+					"time":    readTimeEnd,
+					"content": buf,
+					"tags":    TagValues(buf),
+				}
 
-						// log.Println(lastTime)
-					}
+				if pusher.Due(buf, readTimeEnd) {
 
-					// Wysyłamy ranges do VISU co 5000 ms (ekran PLC)
-					// ==============================================
+					sse.Encode(w, sse.Event{
+						Id:    plcAddress,
+						Event: "data",
+						Data:  dane,
+					})
+					// Wysłanie i poczekanie
+					w.Flush()
 
-					rangesTab := map[string]interface{}{
-						// "time":    readTimeEnd,
-						"content": valuesRange,
-					}
+					// log.Println(plcAddress + " Wysłano: " + strconv.FormatInt(timestamp, 10))
+				}
 
-					cyclesTab := map[string]interface{}{
-						// "time":    readTimeEnd,
-						"content": cyclesFound,
-					}
+				// Wysyłamy ranges do VISU co StatsInterval (ekran PLC)
+				// ==============================================
 
-					if readTimeEnd-lastTime2 > 5000000000 {
+				rangesTab := map[string]interface{}{
+					// "time":    readTimeEnd,
+					"content": valuesRange,
+				}
 
-						sse.Encode(w, sse.Event{
-							Id:    plcAddress,
-							Event: "stats",
-							Data:  rangesTab,
-						})
-						// Wysłanie i poczekanie
-						w.Flush()
+				modelMutex.RLock()
+				cycles := append([]int64(nil), model.cyclesFound...)
+				modelMutex.RUnlock()
+				cyclesTab := map[string]interface{}{
+					// "time":    readTimeEnd,
+					"content": cycles,
+				}
 
-						// Czas ostatniego odczytu z PLC
-						log.Println("Szybkość ostatniego odczytu danych z PLC " + plcAddress + " " + strconv.FormatInt((readTimeEnd-readTimeStart)/1000000, 10) + " ms")
+				if time.Duration(readTimeEnd-lastTime2) > stream.StatsInterval {
 
-						// log.Println("Wysyłam tablicę zmian...")
+					sse.Encode(w, sse.Event{
+						Id:    plcAddress,
+						Event: "stats",
+						Data:  rangesTab,
+					})
+					// Wysłanie i poczekanie
+					w.Flush()
 
-						lastTime2 = time.Now().UnixNano()
-					}
+					// Czas ostatniego odczytu z PLC
+					log.Println("Szybkość ostatniego odczytu danych z PLC " + plcAddress + " " + strconv.FormatInt((readTimeEnd-readTimeStart)/1000000, 10) + " ms")
 
-					// Wysyłamy listę cykli co 5000 ms
-					// ==============================================
+					// log.Println("Wysyłam tablicę zmian...")
 
-					if readTimeEnd-lastTime3 > 5000000000 {
+					lastTime2 = time.Now().UnixNano()
+				}
 
-						sse.Encode(w, sse.Event{
-							Id:    plcAddress,
-							Event: "cycles",
-							Data:  cyclesTab,
-						})
-						// Wysłanie i poczekanie
-						w.Flush()
+				// Wysyłamy listę cykli co CyclesInterval
+				// ==============================================
 
-						// log.Println("Wysyłam tablicę cykli...")
+				if time.Duration(readTimeEnd-lastTime3) > stream.CyclesInterval {
 
-						lastTime3 = time.Now().UnixNano()
-					}
+					sse.Encode(w, sse.Event{
+						Id:    plcAddress,
+						Event: "cycles",
+						Data:  cyclesTab,
+					})
+					// Wysłanie i poczekanie
+					w.Flush()
 
-					time.Sleep(time.Duration(10) * time.Millisecond)
+					// log.Println("Wysyłam tablicę cykli...")
 
-					// licznik
-					ix++
+					lastTime3 = time.Now().UnixNano()
 				}
 
+				// licznik
+				ix++
+
 			}
 		} else {
 			log.Println("Problem z połączeniem z " + plcAddress)
@@ -870,8 +979,8 @@ func eventHandler(c *gin.Context) {
 		}
 	} else {
 
-		log.Println("Odbebrałem niepoprawny adres IP: " + plcAddress)
-		c.JSON(http.StatusOK, "Odbebrałem niepoprawny adres IP: "+plcAddress)
+		log.Println("Niepoprawne parametry PLC: " + plcErr.Error())
+		c.JSON(http.StatusOK, "Niepoprawne parametry PLC: "+plcErr.Error())
 	}
 
 	log.Println("LOOP end for PLC IP " + plcAddress)
@@ -895,6 +1004,23 @@ func eventHandler(c *gin.Context) {
 // ================================================================================================
 func main() {
 
+	// polecenia z linii komend (np. S7 vcd -in nagranie.jsonl)
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := RunCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// konfiguracja: plik YAML, zmienne S7_*, flagi
+	cfg, err := LoadConfig("S7", os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ApplyConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+
 	InitVars()
 
 	// SERVER HTTP
@@ -911,10 +1037,51 @@ func main() {
 	// r.GET("/api/v1/s7", S7Get)
 
 	r.GET("/api/v1/data", SendData)
+	r.GET("/api/v2/model", GetModelV2)
+	r.GET("/api/v2/states", GetStatesV2)
+	r.GET("/api/v2/states/:id", GetStateV2)
+	r.GET("/api/v2/transitions", GetTransitionsV2)
+	r.GET("/api/v2/cycles", GetCyclesV2)
+	r.GET("/api/v2/openapi.yaml", GetOpenAPI)
 	r.GET("/api/v1/s7", eventHandler)
+	r.GET("/api/v1/ws", WsHandler)
+	r.GET("/metrics", GetMetrics)
+	r.GET("/api/v1/plc/connection", GetConnection)
+	r.GET("/api/v1/plc/diagnose", GetDiagnose)
+	r.GET("/api/v1/plc/:id/info", GetPLCInfo)
+	r.GET("/api/v1/plc/clock", GetPLCClock)
+	r.GET("/api/v1/plc/buffer", GetPLCBuffer)
+	r.GET("/api/v1/sampling", GetSampling)
+	r.GET("/api/v1/mqtt", GetMqtt)
+	r.PUT("/api/v1/mqtt", PutMqtt)
+	r.GET("/api/v1/timeline", GetTimeline)
+	r.GET("/api/v1/recording", GetRecording)
+	r.GET("/api/v1/export/vcd", GetVCD)
+	r.GET("/api/v1/export/timeline", GetExportTimeline)
+	r.GET("/api/v1/export/states", GetExportStates)
+	r.GET("/api/v1/export/transitions", GetExportTransitions)
+	r.POST("/api/v1/model/rebuild", PostRebuild)
+	r.GET("/api/v1/model/compare", GetModelCompare)
+	r.GET("/api/v1/model/sequences", GetSequences)
+	r.GET("/api/v1/model/markov", GetMarkov)
+	r.GET("/api/v1/model/predict", GetPredict)
+	r.GET("/api/v1/model/dwell", GetDwell)
+	r.GET("/api/v1/model/dwell/:id", GetDwellState)
+	r.GET("/api/v1/causality", GetCausality)
+	r.POST("/api/v1/model/switch", PostModelSwitch)
+	r.DELETE("/api/v1/model/candidate", DeleteModelCandidate)
+	r.GET("/api/v1/mask", GetMask)
+	r.GET("/api/v1/mask/bits", GetMaskBits)
+	r.PUT("/api/v1/mask/overrides", PutMaskOverrides)
+	r.POST("/api/v1/mask/overrides", PostMaskOverride)
+	r.DELETE("/api/v1/mask/overrides", DeleteMaskOverrides)
+	r.GET("/api/v1/tags", GetTags)
+	r.POST("/api/v1/tags", PostTag)
+	r.DELETE("/api/v1/tags/:name", DeleteTag)
+	r.GET("/api/v1/tags/:name/history", GetTagHistory)
 
 	// Odpalenie drugiego wątku analizy danych
 	go ScanTimeline()
 
-	r.Run(":80")
+	r.Run(config.Listen)
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MarkovTransition - Przejście w łańcuchu Markowa
+// Probability - udział wśród wyjść ze stanu Src, Time - średni czas od wejścia w Src do Dst [ms]
+// ========================================================
+type MarkovTransition struct {
+	Src         int     `json:"Src"`
+	Dst         int     `json:"Dst"`
+	Count       int     `json:"Count"`
+	Probability float64 `json:"Probability"`
+	Time        int64   `json:"Time"`
+}
+
+// MarkovState - Stan w łańcuchu Markowa z oczekiwanym czasem pobytu [ms]
+// ========================================================
+type MarkovState struct {
+	State int                `json:"State"`
+	Exits int                `json:"Exits"`
+	Dwell int64              `json:"Dwell"`
+	Next  []MarkovTransition `json:"Next"`
+}
+
+// BitChange - Zmiana sygnału bitowego potrzebna do przejścia (nazwa zmiennej BOOL lub adres)
+// ========================================================
+type BitChange struct {
+	Signal string `json:"Signal"`
+	Value  bool   `json:"Value"`
+}
+
+// NextState - Możliwy następny stan
+// Time - oczekiwany czas od wejścia w aktualny stan, Remaining - pozostały czas [ms]
+// ========================================================
+type NextState struct {
+	State       int         `json:"State"`
+	Probability float64     `json:"Probability"`
+	Time        int64       `json:"Time"`
+	Remaining   int64       `json:"Remaining"`
+	Changes     []BitChange `json:"Changes"`
+}
+
+// Prediction - Przewidywanie następnego stanu maszyny
+// ========================================================
+type Prediction struct {
+	State   int         `json:"State"`
+	Since   int64       `json:"Since"`   // wejście w stan [ns], 0 gdy stan podany w zapytaniu
+	Elapsed int64       `json:"Elapsed"` // czas w stanie [ms]
+	Dwell   int64       `json:"Dwell"`   // oczekiwany czas pobytu w stanie [ms]
+	Next    []NextState `json:"Next"`
+}
+
+// Aktualny stan maszyny z pętli odczytu (-1 = nieznany) i chwila wejścia w niego (czas serwera)
+// ========================================================
+var liveState = -1
+var liveSince int64
+var liveMutex sync.Mutex
+
+// SetLiveState - Zapis aktualnego stanu z pętli odczytu
+// ================================================================================================
+func SetLiveState(state int, since int64) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	liveState, liveSince = state, since
+}
+
+// LiveState - Aktualny stan maszyny i chwila wejścia w niego
+// ================================================================================================
+func LiveState() (int, int64) {
+	liveMutex.Lock()
+	defer liveMutex.Unlock()
+	return liveState, liveSince
+}
+
+// growMarkov - Macierze przejść na wszystkie stany modelu
+// ================================================================================================
+func (m *Model) growMarkov() {
+	n := len(m.machineStates)
+	for i := range m.markovCounts {
+		for len(m.markovCounts[i]) < n {
+			m.markovCounts[i] = append(m.markovCounts[i], 0)
+			m.markovTimes[i] = append(m.markovTimes[i], 0)
+		}
+	}
+	for len(m.markovCounts) < n {
+		m.markovCounts = append(m.markovCounts, make([]int, n))
+		m.markovTimes = append(m.markovTimes, make([]int64, n))
+	}
+	for len(m.dwell) < n {
+		m.dwell = append(m.dwell, dwellSketch{})
+	}
+}
+
+// AnalyzeMarkov - update liczników przejść (łańcuch Markowa) i czasów pobytu w stanach
+// Przejścia przez STOP CPU i przez obrazy spoza nauczonych stanów nie są liczone
+// (czas pobytu przerwanego w ten sposób jest nieznany)
+// ================================================================================================
+func (m *Model) AnalyzeMarkov(timeline []MachineImage) {
+	m.growMarkov()
+
+	length := len(timeline)
+	for i := m.markovID; i < length; i++ {
+		image := timeline[i]
+		masked := MaskedImage(image.IOImage, m.maskImage)
+		if i > 0 && m.StopBetween(timeline[i-1].Timestamp, image.Timestamp) {
+			m.markovState = -1
+		} else if m.markovState >= 0 && ImageCompare(masked, m.markovImage) == 0 {
+			continue
+		}
+		m.markovImage = masked
+
+		state := m.FindState(masked)
+		if state < 0 || state >= len(m.markovCounts) {
+			m.markovState = -1
+			continue
+		}
+		if state == m.markovState {
+			continue
+		}
+		if m.markovState >= 0 {
+			dwell := (ImageTime(image) - m.markovSince) / 1000000
+			m.markovCounts[m.markovState][state]++
+			m.markovTimes[m.markovState][state] += dwell
+			m.dwell[m.markovState].Add(dwell)
+		}
+		m.markovState, m.markovSince = state, ImageTime(image)
+	}
+	m.markovID = length
+}
+
+// MarkovState - Wyjścia ze stanu z prawdopodobieństwami (najbardziej prawdopodobne pierwsze)
+// ================================================================================================
+func (m *Model) MarkovState(k int) MarkovState {
+	ms := MarkovState{State: k, Next: []MarkovTransition{}}
+	if k < 0 || k >= len(m.markovCounts) {
+		return ms
+	}
+	var dwell int64
+	for dst, count := range m.markovCounts[k] {
+		ms.Exits += count
+		dwell += m.markovTimes[k][dst]
+	}
+	if ms.Exits == 0 {
+		return ms
+	}
+	ms.Dwell = dwell / int64(ms.Exits)
+	for dst, count := range m.markovCounts[k] {
+		if count == 0 {
+			continue
+		}
+		ms.Next = append(ms.Next, MarkovTransition{
+			Src:         k,
+			Dst:         dst,
+			Count:       count,
+			Probability: float64(count) / float64(ms.Exits),
+			Time:        m.markovTimes[k][dst] / int64(count),
+		})
+	}
+	sort.SliceStable(ms.Next, func(i, j int) bool { return ms.Next[i].Count > ms.Next[j].Count })
+	return ms
+}
+
+// StateChanges - Bity do zmiany przy przejściu między stanami (tylko bity pod maską)
+// ================================================================================================
+func (m *Model) StateChanges(src int, dst int, names map[string]string) []BitChange {
+	changes := []BitChange{}
+	for index := 0; index < imageSize; index++ {
+		diff := m.machineStates[src][index] ^ m.machineStates[dst][index]
+		for bit := 0; bit < 8; bit++ {
+			if diff&(1<<uint(bit)) == 0 {
+				continue
+			}
+			name := FormatAddress(index, bit)
+			if tag, ok := names[name]; ok {
+				name = tag
+			}
+			changes = append(changes, BitChange{Signal: name, Value: m.machineStates[dst][index]&(1<<uint(bit)) != 0})
+		}
+	}
+	return changes
+}
+
+// Predict - Najbardziej prawdopodobne następne stany po elapsed [ms] w stanie k
+// ================================================================================================
+func (m *Model) Predict(k int, elapsed int64) Prediction {
+	ms := m.MarkovState(k)
+	p := Prediction{State: k, Elapsed: elapsed, Dwell: ms.Dwell, Next: []NextState{}}
+	names, _ := ParseNames("")
+	for _, trans := range ms.Next {
+		remaining := trans.Time - elapsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		p.Next = append(p.Next, NextState{
+			State:       trans.Dst,
+			Probability: trans.Probability,
+			Time:        trans.Time,
+			Remaining:   remaining,
+			Changes:     m.StateChanges(k, trans.Dst, names),
+		})
+	}
+	return p
+}
+
+// GetMarkov - Łańcuch Markowa modelu (prawdopodobieństwa przejść i czasy pobytu w stanach)
+// ================================================================================================
+func GetMarkov(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetMarkov()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	m := model
+	states := make([]MarkovState, 0, len(m.markovCounts))
+	for k := range m.markovCounts {
+		states = append(states, m.MarkovState(k))
+	}
+	c.JSON(http.StatusOK, states)
+}
+
+// GetPredict - Przewidywany następny stan i czas do niego (state - stan zamiast aktualnego, elapsed [ms])
+// ================================================================================================
+func GetPredict(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetPredict()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	m := model
+	state, since := LiveState()
+	elapsed := int64(0)
+	if str := c.Query("state"); str != "" {
+		k, err := strconv.Atoi(str)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, "Niepoprawny parametr state")
+			return
+		}
+		state, since = k, 0
+	} else if since > 0 {
+		elapsed = (time.Now().UnixNano() - since) / 1000000
+	}
+	if str := c.Query("elapsed"); str != "" {
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil || v < 0 {
+			c.JSON(http.StatusBadRequest, "Niepoprawny parametr elapsed")
+			return
+		}
+		elapsed = v
+	}
+	if state < 0 || state >= len(m.markovCounts) {
+		c.JSON(http.StatusNotFound, "Nieznany stan maszyny")
+		return
+	}
+
+	prediction := m.Predict(state, elapsed)
+	prediction.Since = since
+	c.JSON(http.StatusOK, prediction)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MaskOverride - Ręczne włączenie/wyłączenie bitu lub zakresu bajtów z maski
+// ========================================================
+type MaskOverride struct {
+	Address string `json:"Address"`
+	Length  int    `json:"Length,omitempty"`
+	Mode    string `json:"Mode"`
+	Comment string `json:"Comment,omitempty"`
+
+	addr Address
+}
+
+// maskOverrides - Ręczne zmiany maski (kolejność ma znaczenie - ostatnia wygrywa)
+// ========================================================
+var maskOverrides []MaskOverride
+var maskMutex sync.Mutex
+
+// Validate - Sprawdzenie zmiany maski
+// ================================================================================================
+func (o *MaskOverride) Validate() error {
+	if o.Mode != "include" && o.Mode != "exclude" {
+		return errors.New("niepoprawny tryb " + o.Mode + " (include/exclude)")
+	}
+	addr, err := ParseAddress(o.Address)
+	if err != nil {
+		return err
+	}
+	if o.Length < 0 {
+		return errors.New("ujemna długość zakresu " + o.Address)
+	}
+	if o.Length > 0 {
+		if addr.Bit >= 0 {
+			return errors.New("zakres bajtów wymaga adresu bajtowego " + o.Address)
+		}
+		// zakres w jednym obszarze - M, E albo A
+		if addr.Offset%areaSize+o.Length > areaSize {
+			return errors.New("zakres " + o.Address + " wychodzi poza obszar")
+		}
+		addr.Size = o.Length
+	}
+	o.addr = addr
+	return nil
+}
+
+// ApplyOverrides - Nałożenie ręcznych zmian na maskę
+// ================================================================================================
+func ApplyOverrides(mask [imageSize]byte) [imageSize]byte {
+	maskMutex.Lock()
+	overrides := maskOverrides
+	maskMutex.Unlock()
+	for _, o := range overrides {
+		var bits byte = 0xff
+		size := o.addr.Size
+		if o.addr.Bit >= 0 {
+			bits = 1 << uint(o.addr.Bit)
+			size = 1
+		}
+		for i := o.addr.Offset; i < o.addr.Offset+size; i++ {
+			if o.Mode == "include" {
+				mask[i] |= bits
+			} else {
+				mask[i] &^= bits
+			}
+		}
+	}
+	return mask
+}
+
+// SetMaskOverrides - Nowa lista ręcznych zmian maski
+// Po znalezieniu cykli maska jest przeliczana od razu (a z nią stany modelu), w trakcie
+// szukania cykli zmiany działają od następnego przebiegu AnalyzeCycles
+// ================================================================================================
+func SetMaskOverrides(overrides []MaskOverride) []MaskOverride {
+	maskMutex.Lock()
+	maskOverrides = overrides
+	maskMutex.Unlock()
+
+	modelMutex.Lock()
+	defer modelMutex.Unlock()
+	if len(model.cyclesFound) > 0 {
+		model.AnalyzeMask(machineTimeline)
+	}
+	return overrides
+}
+
+// GetMask - Maska automatyczna, ręczne zmiany i maska wynikowa
+// ================================================================================================
+func GetMask(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetMask()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	maskMutex.Lock()
+	overrides := maskOverrides
+	maskMutex.Unlock()
+	c.JSON(http.StatusOK, gin.H{
+		"Auto":      model.LearnedMask(),
+		"Overrides": overrides,
+		"Effective": model.maskImage,
+	})
+}
+
+// PutMaskOverrides - Zastąpienie listy ręcznych zmian maski
+// ================================================================================================
+func PutMaskOverrides(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PutMaskOverrides()")
+
+	var overrides []MaskOverride
+	if err := c.ShouldBindJSON(&overrides); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	for i := range overrides {
+		if err := overrides[i].Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	c.JSON(http.StatusOK, SetMaskOverrides(overrides))
+}
+
+// PostMaskOverride - Dodanie ręcznej zmiany maski
+// ================================================================================================
+func PostMaskOverride(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PostMaskOverride()")
+
+	var o MaskOverride
+	if err := c.ShouldBindJSON(&o); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := o.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	maskMutex.Lock()
+	overrides := append(append([]MaskOverride(nil), maskOverrides...), o)
+	maskMutex.Unlock()
+	c.JSON(http.StatusOK, SetMaskOverrides(overrides))
+}
+
+// DeleteMaskOverrides - Powrót do maski automatycznej
+// ================================================================================================
+func DeleteMaskOverrides(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("DeleteMaskOverrides()")
+
+	c.JSON(http.StatusOK, SetMaskOverrides(nil))
+}
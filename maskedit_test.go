@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// TestMaskOverrideValidate - Zakres bajtów w jednym obszarze obrazu
+// ================================================================================================
+func TestMaskOverrideValidate(t *testing.T) {
+	o := MaskOverride{Address: "MB120", Length: 8, Mode: "exclude"}
+	if err := o.Validate(); err != nil || o.addr.Offset != 120 || o.addr.Size != 8 {
+		t.Errorf("MB120 x 8: %v, %+v", err, o.addr)
+	}
+	// MB120 + 9 bajtów sięga EB0
+	for _, o := range []MaskOverride{
+		{Address: "MB120", Length: 9, Mode: "exclude"},
+		{Address: "AB127", Length: 2, Mode: "include"},
+		{Address: "MB0", Length: -1, Mode: "exclude"},
+		{Address: "M0.0", Length: 2, Mode: "exclude"},
+		{Address: "MB0", Mode: "toggle"},
+	} {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted", o)
+		}
+	}
+}
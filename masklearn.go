@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maskMinToggles = 6         // minimalna ilość zmian bitu do oceny regularności
+const maskRegularity = 0.15      // współczynnik zmienności okresu poniżej którego bit jest zegarem
+const maskMaxTogglesPerCycle = 8 // ilość zmian na cykl powyżej której bit jest szumem
+const maskStablePasses = 3       // ilość kolejnych przebiegów z nową klasą bitu zanim zmieni się maska
+
+// Klasy bitów obrazu
+const (
+	bitConstant = "constant"
+	bitSequence = "sequence"
+	bitNoise    = "noise"
+)
+
+// BitStats - Statystyka zmienności bitu
+// ========================================================
+type BitStats struct {
+	Ones    int `json:"Ones"`
+	Toggles int `json:"Toggles"`
+
+	lastToggle int64
+	periods    int
+	mean       float64 // średni czas między zmianami [ms]
+	m2         float64
+}
+
+// BitClass - Klasyfikacja bitu z uzasadnieniem
+// ========================================================
+type BitClass struct {
+	Address string  `json:"Address"`
+	Class   string  `json:"Class"`
+	Reason  string  `json:"Reason"`
+	Toggles int     `json:"Toggles"`
+	Ones    int     `json:"Ones"`
+	Period  float64 `json:"Period"`
+}
+
+// UpdateBitStats - update statystyk bitów i valuesRange od ostatnio analizowanego obrazu
+// ================================================================================================
+func (m *Model) UpdateBitStats(timeline []MachineImage) {
+
+	length := len(timeline)
+	for i := m.maskLearnID; i < length; i++ {
+		image := timeline[i]
+		if i == 0 {
+			m.timeFrom = image.Timestamp
+		}
+		m.timeTo = image.Timestamp
+		for index := 0; index < imageSize; index++ {
+			if m.valuesRange[image.IOImage[index]][index] < 255 {
+				m.valuesRange[image.IOImage[index]][index]++
+			}
+			var diff byte
+			if i > 0 {
+				diff = image.IOImage[index] ^ timeline[i-1].IOImage[index]
+			}
+			for bit := 0; bit < 8; bit++ {
+				s := &m.bitStats[index*8+bit]
+				if image.IOImage[index]&(1<<uint(bit)) != 0 {
+					s.Ones++
+				}
+				if diff&(1<<uint(bit)) == 0 {
+					continue
+				}
+				if s.Toggles > 0 {
+					// algorytm Welforda - średnia i wariancja okresu zmian
+					period := float64(image.Timestamp-s.lastToggle) / 1000000
+					s.periods++
+					delta := period - s.mean
+					s.mean += delta / float64(s.periods)
+					s.m2 += delta * (period - s.mean)
+				}
+				s.Toggles++
+				s.lastToggle = image.Timestamp
+			}
+		}
+	}
+	m.maskLearnID = length
+}
+
+// ClassifyBit - Klasyfikacja bitu: stały, istotny dla sekwencji lub szum
+// ================================================================================================
+func (m *Model) ClassifyBit(index int, bit int) BitClass {
+	s := m.bitStats[index*8+bit]
+	bc := BitClass{
+		Address: FormatAddress(index, bit),
+		Toggles: s.Toggles,
+		Ones:    s.Ones,
+		Period:  s.mean,
+	}
+
+	if s.Toggles == 0 {
+		bc.Class = bitConstant
+		bc.Reason = "bit nie zmienia się"
+		return bc
+	}
+
+	if m.analogBytes[index] {
+		bc.Class = bitNoise
+		bc.Reason = "bajt ciągły (licznik lub wartość analogowa)"
+		return bc
+	}
+
+	if s.Toggles >= maskMinToggles && s.mean > 0 {
+		cv := math.Sqrt(s.m2/float64(s.periods)) / s.mean
+		if cv < maskRegularity && s.mean < float64(minCycleTime) {
+			bc.Class = bitNoise
+			bc.Reason = "zmienia się regularnie co " + strconv.FormatFloat(s.mean, 'f', 0, 64) + " ms (zegar/heartbeat)"
+			return bc
+		}
+	}
+
+	if len(m.cyclesFound) > 0 {
+		cycle := m.cyclesFound[0]
+		for _, c := range m.cyclesFound {
+			if c < cycle {
+				cycle = c
+			}
+		}
+		duration := float64(m.timeTo-m.timeFrom) / 1000000
+		if duration > float64(cycle) {
+			perCycle := float64(s.Toggles) / (duration / float64(cycle))
+			if perCycle > maskMaxTogglesPerCycle {
+				bc.Class = bitNoise
+				bc.Reason = "zmienia się " + strconv.FormatFloat(perCycle, 'f', 1, 64) + " razy na cykl"
+				return bc
+			}
+		}
+	}
+
+	bc.Class = bitSequence
+	bc.Reason = "zmienia się " + strconv.Itoa(s.Toggles) + " razy"
+	return bc
+}
+
+// LearnedMask - Maska wyliczona z klasyfikacji bitów (szum wyzerowany)
+// ================================================================================================
+func (m *Model) LearnedMask() [imageSize]byte {
+	var mask [imageSize]byte
+	for index := 0; index < imageSize; index++ {
+		for bit := 0; bit < 8; bit++ {
+			if m.ClassifyBit(index, bit).Class != bitNoise {
+				mask[index] |= 1 << uint(bit)
+			}
+		}
+	}
+	return mask
+}
+
+// StableMask - Maska z histerezą: bit zmienia klasę dopiero gdy nowa klasa utrzyma się przez
+// maskStablePasses kolejnych przebiegów (bit blisko progu klasyfikacji nie resetuje ciągle modelu)
+// Pierwsza nauczona maska jest przyjmowana od razu
+// ================================================================================================
+func (m *Model) StableMask(learned [imageSize]byte) [imageSize]byte {
+	if !m.maskLearnedSet {
+		m.maskLearned = learned
+		m.maskLearnedSet = true
+		return m.maskLearned
+	}
+	for index := 0; index < imageSize; index++ {
+		diff := learned[index] ^ m.maskLearned[index]
+		for bit := 0; bit < 8; bit++ {
+			n := index*8 + bit
+			if diff&(1<<uint(bit)) == 0 {
+				m.maskPasses[n] = 0
+				continue
+			}
+			m.maskPasses[n]++
+			if m.maskPasses[n] >= maskStablePasses {
+				m.maskLearned[index] ^= 1 << uint(bit)
+				m.maskPasses[n] = 0
+			}
+		}
+	}
+	return m.maskLearned
+}
+
+// AnalyzeMask - Uczenie maski w trakcie analizy (z ręcznymi zmianami z maskOverrides)
+// Gdy maska lub lista sygnałów ciągłych się zmieni model stanów jest liczony od nowa z całego timeline
+// ================================================================================================
+func (m *Model) AnalyzeMask(timeline []MachineImage) {
+	m.UpdateBitStats(timeline)
+
+	signals := m.analogSignals
+	m.ClassifySignals()
+
+	mask := ApplyOverrides(m.StableMask(m.LearnedMask()))
+	if ImageCompare(mask, m.maskImage) != 0 || !SameSignals(signals, m.analogSignals) {
+		log.Println("Mask image changed by", ImageCompare(mask, m.maskImage), "bytes - rebuilding states")
+		m.maskImage = mask
+		m.Reset()
+	}
+}
+
+// GetMaskBits - Klasyfikacja bitów obrazu z uzasadnieniem
+// ================================================================================================
+func GetMaskBits(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetMaskBits()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	class := c.Query("class")
+	var bits []BitClass
+	for index := 0; index < imageSize; index++ {
+		for bit := 0; bit < 8; bit++ {
+			bc := model.ClassifyBit(index, bit)
+			if class == "" || class == bc.Class {
+				bits = append(bits, bc)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, bits)
+}
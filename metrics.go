@@ -0,0 +1,153 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// etapy analizy - wartość 1 ma tylko aktualny etap
+var metricsEtaps = []string{"waiting", "AnalyzeCycles", "AnalyzeWrite"}
+
+// Metryki kolektora (etykieta plc = adres sterownika)
+// Ilość obrazów na sekundę: rate(s7_images_total[1m])
+// ========================================================
+var (
+	metricReadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s7_read_duration_seconds",
+		Help:    "Czas odczytu obrazu (MB, EB, AB) z PLC",
+		Buckets: []float64{.002, .005, .01, .02, .05, .1, .2, .5, 1},
+	}, []string{"plc"})
+	metricReadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_read_errors_total",
+		Help: "Błędy odczytu z PLC",
+	}, []string{"plc"})
+	metricConnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_connects_total",
+		Help: "Nawiązane połączenia z PLC (ponowne połączenia)",
+	}, []string{"plc"})
+	metricConnectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_connect_errors_total",
+		Help: "Nieudane próby połączenia z PLC",
+	}, []string{"plc"})
+	metricPollInterval = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s7_poll_interval_seconds",
+		Help:    "Okres między kolejnymi obrazami (jitter próbkowania)",
+		Buckets: []float64{.005, .01, .015, .02, .03, .05, .1, .2, .5},
+	}, []string{"plc"})
+	metricPollOverruns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_poll_overruns_total",
+		Help: "Pominięte takty odczytu (odczyt dłuższy niż okres)",
+	}, []string{"plc"})
+	metricMissedScans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_plc_missed_scans_total",
+		Help: "Cykle OB1 między odczytami, których obrazu nie odczytaliśmy (licznik cykli PLC)",
+	}, []string{"plc"})
+	metricClockOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_plc_clock_offset_seconds",
+		Help: "Zegar PLC minus czas serwera",
+	}, []string{"plc"})
+	metricBufferEntries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_buffer_entries_total",
+		Help: "Wpisy odczytane z bufora zdarzeń PLC",
+	}, []string{"plc"})
+	metricBufferLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_buffer_lost_total",
+		Help: "Wpisy bufora zdarzeń PLC nadpisane przed odczytem",
+	}, []string{"plc"})
+	metricImages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_images_total",
+		Help: "Obrazy odczytane z PLC",
+	}, []string{"plc"})
+	metricTimeline = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_timeline_images",
+		Help: "Ilość obrazów w timeline",
+	}, []string{"plc"})
+	metricStates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_model_states",
+		Help: "Ilość stanów w modelu",
+	}, []string{"plc"})
+	metricTransitions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_model_transitions",
+		Help: "Ilość przejść w modelu",
+	}, []string{"plc"})
+	metricAnalysisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s7_analysis_duration_seconds",
+		Help:    "Czas jednego przebiegu analizy timeline",
+		Buckets: prometheus.ExponentialBuckets(.001, 4, 9),
+	}, []string{"plc", "etap"})
+	metricEtap = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_etap",
+		Help: "Aktualny etap analizy (1 = aktywny)",
+	}, []string{"plc", "etap"})
+	metricMachineState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_machine_state",
+		Help: "Numer aktualnego stanu maszyny (-1 = nieznany)",
+	}, []string{"plc"})
+	metricCycleTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_machine_cycle_seconds",
+		Help: "Czas ostatniego pełnego cyklu maszyny (powrót do stanu 0)",
+	}, []string{"plc"})
+	metricCPURunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "s7_cpu_running",
+		Help: "Stan CPU (1 = RUN, 0 = STOP)",
+	}, []string{"plc"})
+	metricAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "s7_anomalies_total",
+		Help: "Odstępstwa od modelu",
+	}, []string{"plc", "reason"})
+)
+
+// MetricsRead - Metryki odczytu obrazu z PLC
+// ================================================================================================
+func MetricsRead(plc string, d time.Duration, err error) {
+	metricReadDuration.WithLabelValues(plc).Observe(d.Seconds())
+	if err != nil {
+		metricReadErrors.WithLabelValues(plc).Inc()
+	}
+}
+
+// MetricsConnect - Metryki połączenia z PLC
+// ================================================================================================
+func MetricsConnect(plc string, err error) {
+	if err != nil {
+		metricConnectErrors.WithLabelValues(plc).Inc()
+		return
+	}
+	metricConnects.WithLabelValues(plc).Inc()
+}
+
+// MetricsImage - Metryki nowego obrazu w timeline
+// ================================================================================================
+func MetricsImage(plc string, timelineLen int) {
+	metricImages.WithLabelValues(plc).Inc()
+	metricTimeline.WithLabelValues(plc).Set(float64(timelineLen))
+}
+
+// MetricsAnalysis - Metryki przebiegu analizy i modelu
+// ================================================================================================
+func MetricsAnalysis(plc string, stage string, d time.Duration, m *Model) {
+	metricAnalysisDuration.WithLabelValues(plc, stage).Observe(d.Seconds())
+	metricStates.WithLabelValues(plc).Set(float64(len(m.machineStates)))
+	metricTransitions.WithLabelValues(plc).Set(float64(len(m.Transisions)))
+	MetricsEtap(plc, etap)
+}
+
+// MetricsEtap - Aktualny etap analizy
+// ================================================================================================
+func MetricsEtap(plc string, stage string) {
+	for _, e := range metricsEtaps {
+		value := 0.0
+		if e == stage {
+			value = 1
+		}
+		metricEtap.WithLabelValues(plc, e).Set(value)
+	}
+}
+
+// GetMetrics - Metryki w formacie Prometheus
+// ================================================================================================
+var GetMetrics = gin.WrapH(promhttp.Handler())
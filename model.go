@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+// rebuildMaxPrecision - Ile razy zmniejszamy precyzję przy szukaniu cykli w BuildModel
+const rebuildMaxPrecision = 32
+
+// Model - Nauczony model maszyny (cykle, maska, stany, przejścia)
+// Wszystko co powstaje z analizy timeline - można zbudować kilka modeli z różnymi parametrami
+// ========================================================
+type Model struct {
+	ComparePrecision int    `json:"ComparePrecision"`
+	PeriodPrecision  int64  `json:"PeriodPrecision"`
+	Source           string `json:"Source"`
+
+	// cyclesFound - Znalezione cykle
+	cyclesFound []int64
+	// cyclesNrsFound - Numery obrazów które posłużyły za znalezienie cykli
+	cyclesNrsFound []int64
+	firstCycle     bool
+
+	// maskImage - Maska obrazu - wybrane bajty nie są brane pod uwage przy rejestracji stanów maszyny
+	maskImage [imageSize]byte
+	// maskLearned - Nauczona maska bez ręcznych zmian, maskPasses - ilość kolejnych przebiegów
+	// w których klasa bitu różni się od maskLearned
+	maskLearned    [imageSize]byte
+	maskLearnedSet bool
+	maskPasses     [imageSize * 8]int
+	// machineStates - Dane
+	machineStates [][imageSize]byte
+	// statesStatistics - Ile razy występuje stan z machinestates w timeline
+	statesStatistics []int
+	// Transisions - Tablica przejść między stanami
+	Transisions []Transision
+	// statesAnalog - Zakresy sygnałów ciągłych dla każdego stanu z machineStates
+	statesAnalog [][]AnalogRange
+
+	// analogBytes - Bajty sklasyfikowane jako ciągłe (nie wchodzą do klucza stanu)
+	analogBytes [imageSize]bool
+	// analogSignals - Lista sygnałów ciągłych śledzonych w stanach
+	analogSignals []AnalogSignal
+	// bitStats - Statystyki wszystkich bitów obrazu
+	bitStats [imageSize * 8]BitStats
+	// valuesRange - Analiza zmienności danych (jak globalne valuesRange, ale dla timeline modelu)
+	valuesRange [256][imageSize]byte
+	timeFrom    int64
+	timeTo      int64
+	// recordedCPU - Zmiany RUN/STOP z nagrania (cpuRecorded), inaczej zmiany z aktualnego połączenia
+	recordedCPU []CPUStateChange
+	cpuRecorded bool
+	// jitter - Statystyki próbkowania timeline (niepewność czasów przejść)
+	jitter jitterTracker
+	// markovCounts, markovTimes - Łańcuch Markowa: ilość przejść i suma czasów [ms] między stanami
+	markovCounts [][]int
+	markovTimes  [][]int64
+	markovState  int // ostatni stan w AnalyzeMarkov (-1 = nieznany)
+	markovSince  int64
+	markovImage  [imageSize]byte
+	// dwell - Czasy pobytu [ms] w każdym stanie z machineStates
+	dwell []dwellSketch
+
+	writeID     int // ostatnio anlizowany obraz w funkcji Write
+	stateNr     int // ostatnio anlizowany obraz w funkcji AnalyzeStatistics
+	transID     int // ostatnio anlizowany obraz w funkcji Transisions
+	analogID    int // ostatnio anlizowany obraz w funkcji AnalyzeAnalog
+	maskLearnID int // ostatnio anlizowany obraz w funkcji UpdateBitStats
+	jitterID    int // ostatnio anlizowany obraz w funkcji UpdateJitter
+	markovID    int // ostatnio anlizowany obraz w funkcji AnalyzeMarkov
+}
+
+// NewModel - Nowy pusty model z parametrami analizy
+// ================================================================================================
+func NewModel(comparePrecision int, periodPrecision int64) *Model {
+	return &Model{
+		ComparePrecision: comparePrecision,
+		PeriodPrecision:  periodPrecision,
+		markovState:      -1,
+	}
+}
+
+// Reset - reset nauczonych stanów i przejść (cykle, maska i statystyki bitów zostają)
+// ================================================================================================
+func (m *Model) Reset() {
+	m.machineStates = nil
+	m.Transisions = nil
+	m.statesStatistics = nil
+	m.statesAnalog = nil
+	m.markovCounts = nil
+	m.markovTimes = nil
+	m.markovState = -1
+	m.dwell = nil
+	m.writeID = 0
+	m.transID = 0
+	m.stateNr = 0
+	m.analogID = 0
+	m.markovID = 0
+}
+
+// AnalyzeModel - Jeden przebieg uczenia stanów (po znalezieniu cykli)
+// ================================================================================================
+func (m *Model) AnalyzeModel(timeline []MachineImage) {
+	m.AnalyzeMask(timeline)
+	m.AnalyzeWrite(timeline)
+	m.AnalyzeTransitions(timeline)
+	m.AnalyzeStatistics(timeline)
+	m.AnalyzeAnalog(timeline)
+	m.AnalyzeMarkov(timeline)
+}
+
+// StopBetween - Czy między dwoma obrazami timeline modelu CPU było w STOP
+// ================================================================================================
+func (m *Model) StopBetween(from int64, to int64) bool {
+	if m.cpuRecorded {
+		return StopBetween(m.recordedCPU, from, to)
+	}
+	return CPUStopBetween(from, to)
+}
+
+// BuildModel - Cały proces uczenia od nowa na zapisanym timeline aktualnego połączenia
+// ================================================================================================
+func BuildModel(timeline []MachineImage, comparePrecision int, periodPrecision int64) *Model {
+	return NewModel(comparePrecision, periodPrecision).build(timeline, comparePrecision)
+}
+
+// BuildRecordingModel - Cały proces uczenia od nowa na nagraniu (ze zmianami RUN/STOP z nagrania)
+// ================================================================================================
+func BuildRecordingModel(rec Recording, comparePrecision int, periodPrecision int64) *Model {
+	m := NewModel(comparePrecision, periodPrecision)
+	m.recordedCPU = rec.CPU
+	m.cpuRecorded = true
+	return m.build(rec.Timeline, comparePrecision)
+}
+
+// build - Uczenie modelu, precyzja porównania jest zmniejszana aż do znalezienia cykli (jak w ScanTimeline)
+// ================================================================================================
+func (m *Model) build(timeline []MachineImage, comparePrecision int) *Model {
+	for {
+		m.AnalyzeCycles(timeline)
+		if len(m.cyclesFound) > 0 || m.ComparePrecision >= comparePrecision+rebuildMaxPrecision {
+			break
+		}
+		m.ComparePrecision++
+	}
+	if len(m.cyclesFound) == 0 {
+		log.Println("BuildModel: no cycles found up to precision " + strconv.Itoa(m.ComparePrecision))
+	}
+
+	m.AnalyzeModel(timeline)
+	return m
+}
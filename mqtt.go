@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+)
+
+// MqttConfig - Konfiguracja wysyłania zdarzeń przez MQTT
+// Topic - szablon tematu dla formatu json ({plc} = adres PLC, {event} = typ zdarzenia)
+// Retain - ostatni stan maszyny i CPU zostaje na brokerze (tylko zdarzenia "state" i "cpu")
+// ========================================================
+type MqttConfig struct {
+	Enabled  bool   `yaml:"enabled" json:"Enabled"`
+	Broker   string `yaml:"broker" json:"Broker"`
+	ClientID string `yaml:"client_id" json:"ClientID"`
+	Username string `yaml:"username" json:"Username"`
+	Password string `yaml:"password,omitempty" json:"Password,omitempty"`
+	Topic    string `yaml:"topic" json:"Topic"`
+	QoS      byte   `yaml:"qos" json:"QoS"`
+	Retain   bool   `yaml:"retain" json:"Retain"`
+	Format   string `yaml:"format" json:"Format"`
+	Group    string `yaml:"group" json:"Group"`
+	Node     string `yaml:"node" json:"Node"`
+}
+
+// MqttStatus - Stan wysyłania zdarzeń przez MQTT
+// ========================================================
+type MqttStatus struct {
+	Config    MqttConfig `json:"Config"`
+	Connected bool       `json:"Connected"`
+	Published int        `json:"Published"`
+	Errors    int        `json:"Errors"`
+}
+
+// mqttEvents - Zdarzenia wysyłane do MQTT (obrazy i listy cykli zostają w WebSocket/SSE)
+// ========================================================
+var mqttEvents = map[string]bool{"state": true, "transition": true, "cycle": true, "anomaly": true, "cpu": true}
+
+// mqttSink - Aktualne połączenie z brokerem (mqttMutex chroni też liczniki i stan Sparkplug)
+// mqttConfigMutex - jedna zmiana konfiguracji naraz
+// ========================================================
+var mqttSink *MqttSink
+var mqttMutex sync.Mutex
+var mqttConfigMutex sync.Mutex
+
+// MqttSink - Wysyłanie zdarzeń do brokera MQTT
+// ========================================================
+type MqttSink struct {
+	cfg       MqttConfig
+	client    mqtt.Client
+	subID     int
+	done      chan struct{}
+	seq       uint64
+	bdSeq     uint64
+	births    map[string]bool // urządzenia Sparkplug po DBIRTH
+	published int
+	errors    int
+}
+
+// DefaultMqttConfig - Domyślna konfiguracja MQTT
+// ================================================================================================
+func DefaultMqttConfig() MqttConfig {
+	return MqttConfig{
+		ClientID: "s7",
+		Topic:    "s7/{plc}/{event}",
+		QoS:      1,
+		Retain:   true,
+		Format:   "json",
+		Group:    "S7",
+		Node:     "s7",
+	}
+}
+
+// Validate - Sprawdzenie konfiguracji MQTT
+// ================================================================================================
+func (cfg *MqttConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Broker == "" {
+		return errors.New("brak adresu brokera MQTT (np. tcp://localhost:1883)")
+	}
+	if cfg.QoS > 2 {
+		return errors.New("niepoprawny QoS (0, 1, 2)")
+	}
+	switch cfg.Format {
+	case "json":
+		if cfg.Topic == "" {
+			return errors.New("brak tematu MQTT")
+		}
+	case "sparkplug":
+		if cfg.Group == "" || cfg.Node == "" {
+			return errors.New("Sparkplug B wymaga Group i Node")
+		}
+	default:
+		return errors.New("nieznany format " + cfg.Format + " (json, sparkplug)")
+	}
+	return nil
+}
+
+// sparkplugTopic - Temat Sparkplug B (spBv1.0/grupa/typ/węzeł[/urządzenie])
+// ================================================================================================
+func (s *MqttSink) sparkplugTopic(kind string, device string) string {
+	topic := "spBv1.0/" + s.cfg.Group + "/" + kind + "/" + s.cfg.Node
+	if device != "" {
+		// w identyfikatorach Sparkplug nie może być kropek z adresu IP
+		topic += "/" + strings.NewReplacer(".", "_", "/", "_", "+", "_", "#", "_").Replace(device)
+	}
+	return topic
+}
+
+// StartMqtt - Połączenie z brokerem i wysyłanie zdarzeń w tle
+// Klient łączy się ponownie po zerwaniu połączenia (paho AutoReconnect)
+// ================================================================================================
+func StartMqtt(cfg MqttConfig) (*MqttSink, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := &MqttSink{cfg: cfg, done: make(chan struct{}), births: map[string]bool{}}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.Println("MQTT connection lost:", err)
+		})
+
+	if cfg.Format == "sparkplug" {
+		// NDEATH jako testament, NBIRTH po każdym (ponownym) połączeniu
+		// bdSeq rośnie przy każdym połączeniu - NBIRTH i NDEATH tej samej sesji mają ten sam numer
+		s.bdSeq = uint64(time.Now().Unix())
+		opts.SetBinaryWill(s.sparkplugTopic("NDEATH", ""), s.nodeDeath(), 1, false)
+		opts.SetReconnectingHandler(func(c mqtt.Client, o *mqtt.ClientOptions) {
+			mqttMutex.Lock()
+			defer mqttMutex.Unlock()
+			s.bdSeq++
+			o.SetBinaryWill(s.sparkplugTopic("NDEATH", ""), s.nodeDeath(), 1, false)
+		})
+		opts.SetOnConnectHandler(func(c mqtt.Client) {
+			mqttMutex.Lock()
+			defer mqttMutex.Unlock()
+			s.seq = 0
+			s.births = map[string]bool{}
+			birth := SparkplugPayload(uint64(time.Now().UnixNano()/1000000), s.nextSeq(), []spMetric{
+				{"bdSeq", spUInt64, s.bdSeq},
+				{"Node Control/Rebirth", spBoolean, false},
+			})
+			s.publish(s.sparkplugTopic("NBIRTH", ""), birth, false)
+			log.Println("MQTT connected to", cfg.Broker, "(Sparkplug B)")
+		})
+	} else {
+		opts.SetOnConnectHandler(func(c mqtt.Client) {
+			log.Println("MQTT connected to", cfg.Broker)
+		})
+	}
+
+	s.client = mqtt.NewClient(opts)
+	// przy SetConnectRetry token kończy się dopiero po połączeniu - nie czekamy
+	s.client.Connect()
+
+	id, events := SubscribeEvents()
+	s.subID = id
+	go s.run(events)
+	return s, nil
+}
+
+// nodeDeath - Wiadomość NDEATH z numerem bdSeq bieżącego połączenia
+// ================================================================================================
+func (s *MqttSink) nodeDeath() []byte {
+	return SparkplugPayload(uint64(time.Now().UnixNano()/1000000), 0, []spMetric{{"bdSeq", spUInt64, s.bdSeq}})
+}
+
+// nextSeq - Numer kolejny wiadomości Sparkplug (0..255)
+// ================================================================================================
+func (s *MqttSink) nextSeq() uint64 {
+	seq := s.seq
+	s.seq = (s.seq + 1) % 256
+	return seq
+}
+
+// publish - Wysłanie wiadomości (bez czekania na potwierdzenie)
+// ================================================================================================
+func (s *MqttSink) publish(topic string, payload []byte, retained bool) {
+	token := s.client.Publish(topic, s.cfg.QoS, retained, payload)
+	s.published++
+	go func() {
+		if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+			log.Println("MQTT publish", topic, token.Error())
+			mqttMutex.Lock()
+			s.errors++
+			mqttMutex.Unlock()
+		}
+	}()
+}
+
+// run - Pętla wysyłania zdarzeń
+// ================================================================================================
+func (s *MqttSink) run(events <-chan Event) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if !mqttEvents[e.Type] {
+				continue
+			}
+			mqttMutex.Lock()
+			s.send(e)
+			mqttMutex.Unlock()
+		}
+	}
+}
+
+// send - Zdarzenie jako wiadomość JSON lub Sparkplug B
+// ================================================================================================
+func (s *MqttSink) send(e Event) {
+	if s.cfg.Format != "sparkplug" {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			s.errors++
+			return
+		}
+		topic := strings.NewReplacer("{plc}", e.Session, "{event}", e.Type).Replace(s.cfg.Topic)
+		s.publish(topic, payload, s.cfg.Retain && (e.Type == "state" || e.Type == "cpu"))
+		return
+	}
+
+	if !s.client.IsConnectionOpen() {
+		return
+	}
+	timestamp := uint64(e.Time / 1000000)
+	if !s.births[e.Session] {
+		s.publish(s.sparkplugTopic("DBIRTH", e.Session), SparkplugPayload(timestamp, s.nextSeq(), SparkplugBirth()), false)
+		s.births[e.Session] = true
+	}
+	s.publish(s.sparkplugTopic("DDATA", e.Session), SparkplugPayload(timestamp, s.nextSeq(), SparkplugMetrics(e)), false)
+}
+
+// Stop - Zakończenie wysyłania i rozłączenie z brokerem
+// Sparkplug: DDEATH każdego urządzenia po DBIRTH, na końcu NDEATH
+// ================================================================================================
+func (s *MqttSink) Stop() {
+	UnsubscribeEvents(s.subID)
+	close(s.done)
+	if s.cfg.Format == "sparkplug" && s.client.IsConnectionOpen() {
+		mqttMutex.Lock()
+		timestamp := uint64(time.Now().UnixNano() / 1000000)
+		for device := range s.births {
+			s.publish(s.sparkplugTopic("DDEATH", device), SparkplugPayload(timestamp, s.nextSeq(), nil), false)
+		}
+		s.births = map[string]bool{}
+		death := s.nodeDeath()
+		mqttMutex.Unlock()
+		// wiadomości wychodzą w kolejności - po NDEATH wysłane są też DDEATH
+		s.client.Publish(s.sparkplugTopic("NDEATH", ""), 1, false, death).WaitTimeout(5 * time.Second)
+	}
+	s.client.Disconnect(250)
+}
+
+// Status - Stan wysyłania
+// ================================================================================================
+func (s *MqttSink) Status() MqttStatus {
+	mqttMutex.Lock()
+	defer mqttMutex.Unlock()
+	cfg := s.cfg
+	cfg.Password = ""
+	return MqttStatus{Config: cfg, Connected: s.client.IsConnectionOpen(), Published: s.published, Errors: s.errors}
+}
+
+// ConfigureMqtt - Zmiana konfiguracji MQTT (zatrzymanie starego i uruchomienie nowego połączenia)
+// ================================================================================================
+func ConfigureMqtt(cfg MqttConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	mqttConfigMutex.Lock()
+	defer mqttConfigMutex.Unlock()
+
+	// Stop i Status same blokują mqttMutex - tu tylko podmiana wskaźnika
+	mqttMutex.Lock()
+	old := mqttSink
+	mqttSink = nil
+	mqttMutex.Unlock()
+	if old != nil {
+		old.Stop()
+	}
+	if !cfg.Enabled {
+		return nil
+	}
+	s, err := StartMqtt(cfg)
+	if err != nil {
+		return err
+	}
+	mqttMutex.Lock()
+	mqttSink = s
+	mqttMutex.Unlock()
+	return nil
+}
+
+// CurrentMqtt - Aktualne połączenie z brokerem (nil gdy wyłączone)
+// ================================================================================================
+func CurrentMqtt() *MqttSink {
+	mqttMutex.Lock()
+	defer mqttMutex.Unlock()
+	return mqttSink
+}
+
+// GetMqtt - Konfiguracja i stan wysyłania MQTT
+// ================================================================================================
+func GetMqtt(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetMqtt()")
+
+	s := CurrentMqtt()
+	if s == nil {
+		c.JSON(http.StatusOK, MqttStatus{Config: DefaultMqttConfig()})
+		return
+	}
+	c.JSON(http.StatusOK, s.Status())
+}
+
+// PutMqtt - Włączenie/wyłączenie i konfiguracja wysyłania MQTT
+// ================================================================================================
+func PutMqtt(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PutMqtt()")
+
+	cfg := DefaultMqttConfig()
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := ConfigureMqtt(cfg); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	s := CurrentMqtt()
+	if s == nil {
+		cfg.Password = ""
+		c.JSON(http.StatusOK, MqttStatus{Config: cfg})
+		return
+	}
+	c.JSON(http.StatusOK, s.Status())
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// mqttMessage - Wiadomość odebrana z brokera
+// ========================================================
+type mqttMessage struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// startBroker - Broker MQTT w procesie testu na wolnym porcie
+// ================================================================================================
+func startBroker(t *testing.T) (*mochi.Server, string) {
+	t.Helper()
+	srv := mochi.New(nil)
+	if err := srv.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := srv.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv, "tcp://" + tcp.Address()
+}
+
+// subscribe - Klient zapisujący wszystkie wiadomości z tematu
+// ================================================================================================
+func subscribe(t *testing.T, broker string, id string, topic string) func() []mqttMessage {
+	t.Helper()
+	var mutex sync.Mutex
+	var messages []mqttMessage
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(id))
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatal("connect", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(100) })
+	token := client.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		messages = append(messages, mqttMessage{Topic: m.Topic(), Payload: m.Payload(), Retained: m.Retained()})
+	})
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatal("subscribe", token.Error())
+	}
+	return func() []mqttMessage {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]mqttMessage(nil), messages...)
+	}
+}
+
+// waitFor - Czekanie na warunek (najwyżej 5 s)
+// ================================================================================================
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("timeout:", what)
+}
+
+// TestMqttJSON - Tematy JSON z szablonu i flaga retain tylko dla stanu maszyny i CPU
+// ================================================================================================
+func TestMqttJSON(t *testing.T) {
+	_, broker := startBroker(t)
+
+	tests := []struct {
+		session  string
+		retain   bool
+		retained []string
+	}{
+		{"10.0.0.1", true, []string{"s7/10.0.0.1/cpu", "s7/10.0.0.1/state"}},
+		{"10.0.0.2", false, nil},
+	}
+	for _, tt := range tests {
+		live := subscribe(t, broker, "live-"+tt.session, "s7/"+tt.session+"/#")
+
+		cfg := DefaultMqttConfig()
+		cfg.Enabled, cfg.Broker, cfg.Retain = true, broker, tt.retain
+		if err := ConfigureMqtt(cfg); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "sink connected", func() bool { return CurrentMqtt().Status().Connected })
+
+		PublishEvent(Event{Session: tt.session, Type: "state", Time: 1, Data: StateEvent{State: 3}})
+		PublishEvent(Event{Session: tt.session, Type: "image", Time: 2})
+		PublishEvent(Event{Session: tt.session, Type: "transition", Time: 3, Data: TransitionEvent{Src: 1, Dst: 3, Time: 500}})
+		PublishEvent(Event{Session: tt.session, Type: "cpu", Time: 4, Data: CPUStateChange{State: "RUN", Previous: "STOP"}})
+		waitFor(t, "live messages", func() bool { return len(live()) == 3 })
+
+		// obrazy nie są wysyłane, temat z szablonu {plc}/{event}
+		want := []string{"s7/" + tt.session + "/state", "s7/" + tt.session + "/transition", "s7/" + tt.session + "/cpu"}
+		for i, m := range live() {
+			if m.Topic != want[i] {
+				t.Errorf("%s: message %d topic %s, want %s", tt.session, i, m.Topic, want[i])
+			}
+		}
+		var e struct {
+			Session string
+			Type    string
+			Data    StateEvent
+		}
+		if err := json.Unmarshal(live()[0].Payload, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Session != tt.session || e.Type != "state" || e.Data.State != 3 {
+			t.Errorf("%s: state payload %s", tt.session, live()[0].Payload)
+		}
+
+		// nowy odbiorca dostaje z brokera tylko wiadomości z retain
+		late := subscribe(t, broker, "late-"+tt.session, "s7/"+tt.session+"/#")
+		time.Sleep(200 * time.Millisecond)
+		got := late()
+		if len(got) != len(tt.retained) {
+			t.Fatalf("%s: %d retained messages, want %d", tt.session, len(got), len(tt.retained))
+		}
+		topics := map[string]bool{}
+		for _, m := range got {
+			if !m.Retained {
+				t.Errorf("%s: %s without retain flag", tt.session, m.Topic)
+			}
+			topics[m.Topic] = true
+		}
+		for _, topic := range tt.retained {
+			if !topics[topic] {
+				t.Errorf("%s: %s not retained", tt.session, topic)
+			}
+		}
+	}
+
+	if err := ConfigureMqtt(MqttConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if CurrentMqtt() != nil {
+		t.Error("sink not stopped")
+	}
+}
+
+// TestMqttSparkplug - Sesja Sparkplug B: bdSeq przy ponownym połączeniu, DDEATH i NDEATH przy zatrzymaniu
+// ================================================================================================
+func TestMqttSparkplug(t *testing.T) {
+	srv, broker := startBroker(t)
+	host := subscribe(t, broker, "host", "spBv1.0/#")
+	// kind - wiadomości danego typu (NBIRTH, DDATA, ...) w kolejności odbioru
+	kind := func(k string) []mqttMessage {
+		var result []mqttMessage
+		for _, m := range host() {
+			if strings.Split(m.Topic, "/")[2] == k {
+				result = append(result, m)
+			}
+		}
+		return result
+	}
+	bdSeq := func(m mqttMessage) interface{} {
+		for _, metric := range decodeSparkplug(t, m.Payload).Metrics {
+			if metric.Name == "bdSeq" {
+				return metric.Value
+			}
+		}
+		return nil
+	}
+
+	cfg := DefaultMqttConfig()
+	cfg.Enabled, cfg.Broker, cfg.Format, cfg.ClientID = true, broker, "sparkplug", "node"
+	if err := ConfigureMqtt(cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "NBIRTH", func() bool { return len(kind("NBIRTH")) == 1 })
+	first := bdSeq(kind("NBIRTH")[0])
+	PublishEvent(Event{Session: "10.0.0.1", Type: "state", Time: 1, Data: StateEvent{State: 3}})
+	waitFor(t, "DDATA", func() bool { return len(kind("DDATA")) == 1 })
+	if births := kind("DBIRTH"); len(births) != 1 || births[0].Topic != "spBv1.0/S7/DBIRTH/s7/10_0_0_1" {
+		t.Fatalf("DBIRTH %v", births)
+	}
+
+	// zerwane połączenie - broker wysyła testament, nowy NBIRTH ma następny bdSeq
+	cl, ok := srv.Clients.Get("node")
+	if !ok {
+		t.Fatal("node not connected")
+	}
+	cl.Stop(errors.New("test"))
+	waitFor(t, "rebirth", func() bool { return len(kind("NBIRTH")) == 2 && len(kind("NDEATH")) == 1 })
+	second := bdSeq(kind("NBIRTH")[1])
+	if bdSeq(kind("NDEATH")[0]) != first || second != first.(uint64)+1 {
+		t.Errorf("bdSeq: NBIRTH %v, will %v, NBIRTH after reconnect %v", first, bdSeq(kind("NDEATH")[0]), second)
+	}
+	PublishEvent(Event{Session: "10.0.0.1", Type: "state", Time: 2, Data: StateEvent{State: 4}})
+	waitFor(t, "DBIRTH after reconnect", func() bool { return len(kind("DBIRTH")) == 2 })
+
+	// zatrzymanie - DDEATH urządzenia, potem NDEATH z bdSeq bieżącego połączenia
+	if err := ConfigureMqtt(MqttConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "NDEATH", func() bool { return len(kind("NDEATH")) == 2 })
+	deaths := kind("DDEATH")
+	if len(deaths) != 1 || deaths[0].Topic != "spBv1.0/S7/DDEATH/s7/10_0_0_1" {
+		t.Errorf("DDEATH %v", deaths)
+	}
+	if got := bdSeq(kind("NDEATH")[1]); got != second {
+		t.Errorf("NDEATH bdSeq %v, want %v", got, second)
+	}
+}
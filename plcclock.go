@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robinson/gos7"
+)
+
+// PLCClockConfig - Znacznik czasu lub licznik cykli utrzymywany przez program PLC, czytany razem z obrazem
+// Type: "counter" - UDINT zwiększany w każdym cyklu OB1 (pominięte cykle między odczytami),
+// "ticks" - TIME_TCK [ms] (DINT), "dtl" - DTL z RD_SYS_T (S7-1200/1500), "dt" - DATE_AND_TIME (S7-300/400)
+// ========================================================
+type PLCClockConfig struct {
+	DB     int    `yaml:"db" json:"DB"`
+	Offset int    `yaml:"offset" json:"Offset"`
+	Type   string `yaml:"type" json:"Type"`
+}
+
+// plcClockSizes - Rozmiar znacznika w bajtach dla typu
+// ========================================================
+var plcClockSizes = map[string]int{"counter": 4, "ticks": 4, "dtl": 12, "dt": 8}
+
+// counterMinScanTime - Najkrótszy możliwy cykl OB1 - większy przyrost licznika w czasie między odczytami
+// oznacza wyzerowanie lub przestawienie licznika przez program
+const counterMinScanTime = 100 * time.Microsecond
+
+// Validate - Sprawdzenie adresu i typu znacznika
+// ================================================================================================
+func (c *PLCClockConfig) Validate(name string) error {
+	c.Type = strings.ToLower(c.Type)
+	if _, ok := plcClockSizes[c.Type]; !ok {
+		return errors.New("nieznany typ zegara PLC " + c.Type + " (counter, ticks, dtl, dt) dla PLC " + name)
+	}
+	if c.DB < 1 || c.DB > 65535 || c.Offset < 0 {
+		return errors.New("niepoprawny adres zegara PLC DB" + strconv.Itoa(c.DB) + ".DBB" + strconv.Itoa(c.Offset) + " dla PLC " + name)
+	}
+	return nil
+}
+
+// Size - Rozmiar znacznika w bajtach
+// ================================================================================================
+func (c *PLCClockConfig) Size() int {
+	return plcClockSizes[c.Type]
+}
+
+// PLCClockStats - Korelacja czasu PLC z czasem serwera w sesji
+// Offset - zegar PLC minus czas serwera [ms] (dla "ticks" liczony od pierwszego odczytu - dryf)
+// ========================================================
+type PLCClockStats struct {
+	Type        string  `json:"Type"`
+	Samples     int     `json:"Samples"`
+	Scans       int64   `json:"Scans,omitempty"`       // cykle OB1 od pierwszego odczytu
+	MissedScans int64   `json:"MissedScans,omitempty"` // cykle, których obrazu nie odczytaliśmy
+	MaxScanGap  int64   `json:"MaxScanGap,omitempty"`  // najwięcej cykli między dwoma odczytami
+	Repeated    int     `json:"Repeated,omitempty"`    // odczyty z tego samego cyklu co poprzedni
+	Resets      int     `json:"Resets,omitempty"`      // nieprawdopodobne skoki licznika (liczone od nowa)
+	ScanTime    float64 `json:"ScanTime,omitempty"`    // [ms] średni czas cyklu OB1
+	Offset      float64 `json:"Offset"`
+	OffsetMin   float64 `json:"OffsetMin"`
+	OffsetMax   float64 `json:"OffsetMax"`
+}
+
+// plcClock - Dekodowanie znacznika PLC w sesji (przepełnienia licznika, pominięte cykle, offset zegara)
+// ========================================================
+type plcClock struct {
+	cfg      PLCClockConfig
+	session  string
+	started  bool
+	lastRaw  uint32
+	lastTime int64 // czas serwera poprzedniego odczytu
+	counter  int64
+	plcTime  int64
+	scanTime int64 // [ns] czas serwera objęty policzonymi cyklami
+	stats    PLCClockStats
+}
+
+// sessionClock - Znacznik PLC aktualnej sesji (nil gdy nie skonfigurowany)
+// ========================================================
+var sessionClock *plcClock
+var plcClockMutex sync.Mutex
+
+// StartPLCClock - Nowa sesja ze znacznikiem PLC
+// ================================================================================================
+func StartPLCClock(session string, cfg *PLCClockConfig) *plcClock {
+	plcClockMutex.Lock()
+	defer plcClockMutex.Unlock()
+	sessionClock = nil
+	if cfg != nil {
+		sessionClock = &plcClock{cfg: *cfg, session: session, stats: PLCClockStats{Type: cfg.Type}}
+	}
+	return sessionClock
+}
+
+// Decode - Znacznik z bufora do obrazu (PLCCounter lub PLCTime)
+// ================================================================================================
+func (p *plcClock) Decode(data []byte, image *MachineImage) {
+	plcClockMutex.Lock()
+	defer plcClockMutex.Unlock()
+	if len(data) < p.cfg.Size() {
+		return
+	}
+	first := p.stats.Samples == 0
+	started := p.started
+	p.started = true
+	p.stats.Samples++
+
+	switch p.cfg.Type {
+	case "counter":
+		raw := binary.BigEndian.Uint32(data)
+		if started {
+			// różnica modulo 2^32 - przepełnienie licznika nie przeszkadza
+			delta := int64(raw - p.lastRaw)
+			if delta > (image.Timestamp-p.lastTime)/int64(counterMinScanTime)+1 {
+				// licznik wyzerowany lub przestawiony - nowy punkt odniesienia, cykli nie liczymy
+				log.Println("PLC counter jumped from", p.lastRaw, "to", raw, "- counting from new value")
+				p.stats.Resets++
+				p.lastRaw = raw
+				p.lastTime = image.Timestamp
+				image.PLCCounter = p.counter
+				return
+			}
+			p.counter += delta
+			p.stats.Scans += delta
+			switch {
+			case delta == 0:
+				p.stats.Repeated++
+			case delta > 1:
+				p.stats.MissedScans += delta - 1
+				metricMissedScans.WithLabelValues(p.session).Add(float64(delta - 1))
+			}
+			if delta > p.stats.MaxScanGap {
+				p.stats.MaxScanGap = delta
+			}
+			p.scanTime += image.Timestamp - p.lastTime
+			if p.stats.Scans > 0 {
+				p.stats.ScanTime = float64(p.scanTime) / 1e6 / float64(p.stats.Scans)
+			}
+		}
+		p.lastRaw = raw
+		p.lastTime = image.Timestamp
+		image.PLCCounter = p.counter
+		return
+	case "ticks":
+		// TIME_TCK zaczyna od zera - zegar liczony od czasu serwera pierwszego odczytu
+		raw := uint32(PLCTimeValue("ticks", data))
+		if !started {
+			p.plcTime = image.Timestamp
+		} else {
+			p.plcTime += TicksDelta(p.lastRaw, raw)
+		}
+		p.lastRaw = raw
+	default:
+		p.plcTime = PLCTimeValue(p.cfg.Type, data)
+		if p.plcTime == 0 {
+			// niepoprawna data w PLC - zostaje czas serwera
+			p.plcTime = image.Timestamp
+		}
+	}
+	image.PLCTime = p.plcTime
+
+	offset := float64(p.plcTime-image.Timestamp) / 1e6
+	p.stats.Offset = offset
+	if first || offset < p.stats.OffsetMin {
+		p.stats.OffsetMin = offset
+	}
+	if first || offset > p.stats.OffsetMax {
+		p.stats.OffsetMax = offset
+	}
+	metricClockOffset.WithLabelValues(p.session).Set(offset / 1000)
+}
+
+// Break - Przerwa w odczytach (STOP CPU) - licznik i TIME_TCK mogły się wyzerować, liczymy od nowa
+// ================================================================================================
+func (p *plcClock) Break() {
+	plcClockMutex.Lock()
+	defer plcClockMutex.Unlock()
+	p.started = false
+}
+
+// PLCTimeValue - Wartość znacznika czasu PLC: "ticks" - TIME_TCK [ms], "dtl" i "dt" - czas [ns]
+// Dla niepoprawnej daty (np. pusty DTL z rokiem 0 - poza zakresem UnixNano) zwraca 0
+// ================================================================================================
+func PLCTimeValue(typ string, data []byte) int64 {
+	switch typ {
+	case "ticks":
+		return int64(binary.BigEndian.Uint32(data) & 0x7fffffff)
+	case "dtl":
+		year := int(binary.BigEndian.Uint16(data))
+		if year < 1970 || year > 2261 || data[2] < 1 || data[2] > 12 || data[3] < 1 || data[3] > 31 {
+			return 0
+		}
+		nanos := int(binary.BigEndian.Uint32(data[8:]))
+		return time.Date(year, time.Month(data[2]), int(data[3]), int(data[5]), int(data[6]), int(data[7]), nanos, time.UTC).UnixNano()
+	case "dt":
+		// miesiąc i dzień w BCD - zera w pustym DATE_AND_TIME
+		if data[1] < 0x01 || data[1] > 0x12 || data[2] < 0x01 || data[2] > 0x31 {
+			return 0
+		}
+		var helper gos7.Helper
+		return helper.GetDateTimeAt(data, 0).UnixNano()
+	}
+	return 0
+}
+
+// TicksDelta - Czas między dwoma odczytami TIME_TCK [ns] (licznik 0..2^31-1 ms się przepełnia)
+// ================================================================================================
+func TicksDelta(from uint32, to uint32) int64 {
+	return int64((to-from)&0x7fffffff) * int64(time.Millisecond)
+}
+
+// ImageTime - Chwila obrazu [ns] do liczenia czasów przejść i cykli
+// Zegar PLC, gdy jest czytany - bez opóźnień sieci i czasu odczytu; inaczej czas serwera
+// ================================================================================================
+func ImageTime(image MachineImage) int64 {
+	if image.PLCTime != 0 {
+		return image.PLCTime
+	}
+	return image.Timestamp
+}
+
+// GetPLCClock - Korelacja zegara lub licznika cykli PLC z czasem serwera
+// ================================================================================================
+func GetPLCClock(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetPLCClock()")
+
+	plcClockMutex.Lock()
+	defer plcClockMutex.Unlock()
+	if sessionClock == nil {
+		c.JSON(http.StatusNotFound, "Zegar PLC nie jest skonfigurowany")
+		return
+	}
+	c.JSON(http.StatusOK, sessionClock.stats)
+}
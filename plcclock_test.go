@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// TestTicksDelta - Czas między odczytami TIME_TCK z przepełnieniem licznika
+// ================================================================================================
+func TestTicksDelta(t *testing.T) {
+	if got := TicksDelta(1000, 1010); got != int64(10*time.Millisecond) {
+		t.Errorf("TicksDelta(1000, 1010) = %v", time.Duration(got))
+	}
+	if got := TicksDelta(5, 5); got != 0 {
+		t.Errorf("TicksDelta(5, 5) = %v", time.Duration(got))
+	}
+	// TIME_TCK liczy do 2^31-1 ms i zaczyna od zera
+	if got := TicksDelta(0x7FFFFFFF-9, 10); got != int64(20*time.Millisecond) {
+		t.Errorf("TicksDelta over 2^31 = %v, want 20ms", time.Duration(got))
+	}
+	// cofnięcie o 1 ms to prawie pełny obieg licznika
+	if got := TicksDelta(10, 9); got != int64(0x7FFFFFFF*time.Millisecond) {
+		t.Errorf("TicksDelta(10, 9) = %v", time.Duration(got))
+	}
+}
+
+// TestPLCClockCounter - Licznik cykli OB1: pominięte cykle, przepełnienie i wyzerowanie licznika
+// ================================================================================================
+func TestPLCClockCounter(t *testing.T) {
+	p := &plcClock{cfg: PLCClockConfig{Type: "counter", DB: 1}, session: "test"}
+	sample := func(raw uint32, ms int64) int64 {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, raw)
+		image := MachineImage{Timestamp: ms * int64(time.Millisecond)}
+		p.Decode(data, &image)
+		return image.PLCCounter
+	}
+
+	if c := sample(5000, 0); c != 0 {
+		t.Errorf("first sample: counter %d, want 0", c)
+	}
+	if c := sample(5001, 10); c != 1 {
+		t.Errorf("next scan: counter %d, want 1", c)
+	}
+	if c := sample(5001, 15); c != 1 {
+		t.Errorf("same scan: counter %d, want 1", c)
+	}
+	if c := sample(5011, 25); c != 11 {
+		t.Errorf("missed scans: counter %d, want 11", c)
+	}
+	// licznik mniejszy niż poprzednio - wyzerowanie, nowy punkt odniesienia
+	if c := sample(3, 35); c != 11 {
+		t.Errorf("reset: counter %d, want 11", c)
+	}
+	if c := sample(8, 45); c != 16 {
+		t.Errorf("after reset: counter %d, want 16", c)
+	}
+	// przestawienie licznika tuż pod 2^32, a potem przepełnienie
+	sample(0xFFFFFFF0, 55)
+	if c := sample(4, 65); c != 36 {
+		t.Errorf("overflow: counter %d, want 36", c)
+	}
+
+	if s := p.stats; s.Repeated != 1 || s.MissedScans != 32 || s.MaxScanGap != 20 || s.Resets != 2 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+// TestPLCTimeValue - Znacznik DTL i DATE_AND_TIME, pusta data bez przepełnienia UnixNano
+// ================================================================================================
+func TestPLCTimeValue(t *testing.T) {
+	want := time.Date(2024, 3, 15, 10, 30, 45, 123000000, time.UTC).UnixNano()
+	dtl := []byte{0x07, 0xE8, 3, 15, 5, 10, 30, 45, 0x07, 0x54, 0xD4, 0xC0}
+	if got := PLCTimeValue("dtl", dtl); got != want {
+		t.Errorf("dtl = %v, want %v", time.Unix(0, got).UTC(), time.Unix(0, want).UTC())
+	}
+	dt := []byte{0x24, 0x03, 0x15, 0x10, 0x30, 0x45, 0x12, 0x35}
+	if got := PLCTimeValue("dt", dt); got != want {
+		t.Errorf("dt = %v, want %v", time.Unix(0, got).UTC(), time.Unix(0, want).UTC())
+	}
+	if got := PLCTimeValue("dtl", make([]byte, 12)); got != 0 {
+		t.Errorf("empty dtl = %d, want 0", got)
+	}
+	if got := PLCTimeValue("dt", make([]byte, 8)); got != 0 {
+		t.Errorf("empty dt = %d, want 0", got)
+	}
+
+	// pusta data w PLC - zostaje czas serwera
+	p := &plcClock{cfg: PLCClockConfig{Type: "dtl", DB: 1}, session: "test"}
+	image := MachineImage{Timestamp: want}
+	p.Decode(make([]byte, 12), &image)
+	if image.PLCTime != want {
+		t.Errorf("PLCTime = %d, want server time %d", image.PLCTime, want)
+	}
+}
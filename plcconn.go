@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robinson/gos7"
+)
+
+// localTSAP - Lokalny TSAP ustawiany na stałe przez gos7 (pola transportu nie są dostępne poza pakietem),
+// dlatego można wybrać tylko zdalny TSAP
+const localTSAP = 0x0100
+
+// connectionTypes - Typy połączenia S7 (starszy bajt zdalnego TSAP)
+// ========================================================
+var connectionTypes = map[string]int{"PG": 1, "OP": 2, "BASIC": 3}
+
+// ConnectAttempt - Wynik próby połączenia z PLC
+// ========================================================
+type ConnectAttempt struct {
+	Address        string `json:"Address"`
+	Rack           int    `json:"Rack"`
+	Slot           int    `json:"Slot"`
+	ConnectionType string `json:"ConnectionType"`
+	LocalTSAP      string `json:"LocalTSAP"`
+	RemoteTSAP     string `json:"RemoteTSAP"`
+	OK             bool   `json:"OK"`
+	Error          string `json:"Error,omitempty"`
+	PDULength      int    `json:"PDULength,omitempty"`
+	Duration       int64  `json:"Duration"` // [ms]
+	Time           int64  `json:"Time"`
+}
+
+// lastConnection - Ostatnia próba połączenia z pętli odczytu
+// ========================================================
+var lastConnection *ConnectAttempt
+
+// ParseTSAP - TSAP z tekstu ("01.02", "0x0102", "0102")
+// ================================================================================================
+func ParseTSAP(str string) (uint16, error) {
+	s := strings.ToLower(strings.TrimSpace(str))
+	s = strings.TrimPrefix(s, "0x")
+	s = strings.ReplaceAll(s, ".", "")
+	value, err := strconv.ParseUint(s, 16, 16)
+	if err != nil || len(s) != 4 {
+		return 0, errors.New("niepoprawny TSAP " + str + " (np. 01.02 lub 0x0102)")
+	}
+	return uint16(value), nil
+}
+
+// FormatTSAP - TSAP w zapisie TIA Portal ("01.02")
+// ================================================================================================
+func FormatTSAP(tsap uint16) string {
+	const digits = "0123456789ABCDEF"
+	return string([]byte{digits[tsap>>12], digits[tsap>>8&0xf], '.', digits[tsap>>4&0xf], digits[tsap&0xf]})
+}
+
+// validateConnection - Sprawdzenie typu połączenia i TSAP
+// ================================================================================================
+func (p *PLCConfig) validateConnection(name string) error {
+	p.ConnectionType = strings.ToUpper(p.ConnectionType)
+	if p.ConnectionType == "" {
+		p.ConnectionType = "PG"
+	}
+	if _, ok := connectionTypes[p.ConnectionType]; !ok {
+		return errors.New("nieznany typ połączenia " + p.ConnectionType + " (PG, OP, BASIC) dla PLC " + name)
+	}
+	if p.RemoteTSAP != "" {
+		if _, err := ParseTSAP(p.RemoteTSAP); err != nil {
+			return errors.New(err.Error() + " dla PLC " + name)
+		}
+	}
+	return nil
+}
+
+// RemoteTSAPValue - Zdalny TSAP (jawny lub z typu połączenia, racka i slotu)
+// ================================================================================================
+func (p *PLCConfig) RemoteTSAPValue() uint16 {
+	if p.RemoteTSAP != "" {
+		if tsap, err := ParseTSAP(p.RemoteTSAP); err == nil {
+			return tsap
+		}
+	}
+	connType, ok := connectionTypes[p.ConnectionType]
+	if !ok {
+		connType = connectionTypes["PG"]
+	}
+	return uint16(connType)<<8 + uint16(p.Rack)*0x20 + uint16(p.Slot)
+}
+
+// NewPLCHandler - Handler TCP dla PLC
+// Jawny zdalny TSAP jest rozkładany na typ połączenia, rack i slot, z których gos7 składa go z powrotem
+// ================================================================================================
+func NewPLCHandler(p PLCConfig) *gos7.TCPClientHandler {
+	tsap := p.RemoteTSAPValue()
+	handler := gos7.NewTCPClientHandlerWithConnectType(p.Address, int(tsap&0xff)>>5, int(tsap&0x1f), int(tsap>>8))
+	handler.Timeout = p.Timeout
+	handler.IdleTimeout = p.IdleTimeout
+	handler.PDULength = p.PDULength
+	return handler
+}
+
+// ConnectPLC - Połączenie z PLC z opisem użytych parametrów
+// ================================================================================================
+func ConnectPLC(p PLCConfig) (*gos7.TCPClientHandler, ConnectAttempt, error) {
+	tsap := p.RemoteTSAPValue()
+	attempt := ConnectAttempt{
+		Address:        p.Address,
+		Rack:           int(tsap&0xff) >> 5,
+		Slot:           int(tsap & 0x1f),
+		ConnectionType: "TSAP", // starszy bajt jawnego zdalnego TSAP spoza PG, OP, BASIC
+		LocalTSAP:      FormatTSAP(localTSAP),
+		RemoteTSAP:     FormatTSAP(tsap),
+		Time:           time.Now().UnixNano(),
+	}
+	for name, t := range connectionTypes {
+		if t == int(tsap>>8) {
+			attempt.ConnectionType = name
+		}
+	}
+
+	handler := NewPLCHandler(p)
+	start := time.Now()
+	err := handler.Connect()
+	attempt.Duration = time.Since(start).Milliseconds()
+	MetricsConnect(p.Address, err)
+	if err != nil {
+		attempt.Error = err.Error()
+		return handler, attempt, err
+	}
+	attempt.OK = true
+	attempt.PDULength = handler.PDULength
+	return handler, attempt, nil
+}
+
+// DiagnoseConnection - Próby połączenia z parametrami z konfiguracji,
+// a przy scan także z typowymi kombinacjami typu połączenia, racka i slotu (do pierwszego sukcesu)
+// ================================================================================================
+func DiagnoseConnection(p PLCConfig, scan bool) []ConnectAttempt {
+	candidates := []PLCConfig{p}
+	if scan {
+		// krótszy timeout - sterownik zwykle odrzuca złe TSAP od razu
+		if p.Timeout > 2*time.Second {
+			p.Timeout = 2 * time.Second
+		}
+		p.RemoteTSAP = ""
+		for _, connType := range []string{"PG", "OP", "BASIC"} {
+			for _, rs := range [][2]int{{p.Rack, p.Slot}, {0, 2}, {0, 1}, {0, 0}, {0, 3}, {0, 4}} {
+				c := p
+				c.ConnectionType, c.Rack, c.Slot = connType, rs[0], rs[1]
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	var attempts []ConnectAttempt
+	tried := map[uint16]bool{}
+	for _, c := range candidates {
+		tsap := c.RemoteTSAPValue()
+		if tried[tsap] {
+			continue
+		}
+		tried[tsap] = true
+		handler, attempt, err := ConnectPLC(c)
+		attempts = append(attempts, attempt)
+		if err == nil {
+			handler.Close()
+			break
+		}
+	}
+	return attempts
+}
+
+// PLCFromQuery - Parametry PLC z konfiguracji (plc = nazwa lub plc_address) nadpisane parametrami zapytania
+// (rack_nr, slot_nr, conn_type, remote_tsap)
+// ================================================================================================
+func PLCFromQuery(c *gin.Context) (PLCConfig, error) {
+	plc := config.FindPLC(c.DefaultQuery("plc", c.Query("plc_address")))
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"rack_nr", &plc.Rack}, {"slot_nr", &plc.Slot}} {
+		if str := c.Query(param.name); str != "" {
+			value, err := strconv.Atoi(str)
+			if err != nil {
+				return plc, errors.New("niepoprawny parametr " + param.name)
+			}
+			*param.value = value
+		}
+	}
+	if connType := c.Query("conn_type"); connType != "" {
+		plc.ConnectionType = connType
+		plc.RemoteTSAP = ""
+	}
+	if tsap := c.Query("remote_tsap"); tsap != "" {
+		plc.RemoteTSAP = tsap
+	}
+	return plc, plc.Validate()
+}
+
+// GetConnection - Parametry ostatniego połączenia z PLC
+// ================================================================================================
+func GetConnection(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetConnection()")
+
+	if lastConnection == nil {
+		c.JSON(http.StatusNotFound, "Brak połączenia z PLC")
+		return
+	}
+	c.JSON(http.StatusOK, lastConnection)
+}
+
+// GetDiagnose - Diagnostyka połączenia (scan=1 - szukanie działającej kombinacji parametrów)
+// ================================================================================================
+func GetDiagnose(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetDiagnose()")
+
+	plc, err := PLCFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	scan := c.Query("scan") == "1" || c.Query("scan") == "true"
+	attempts := DiagnoseConnection(plc, scan)
+
+	result := gin.H{"Attempts": attempts}
+	if last := attempts[len(attempts)-1]; last.OK {
+		result["Working"] = last
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseTSAP - TSAP w zapisie TIA Portal i szesnastkowym
+// ================================================================================================
+func TestParseTSAP(t *testing.T) {
+	valid := map[string]uint16{
+		"01.02":   0x0102,
+		" 10.00 ": 0x1000,
+		"ff.ff":   0xFFFF,
+		"0x0302":  0x0302,
+		"0X4D57":  0x4D57,
+		"0102":    0x0102,
+	}
+	for str, want := range valid {
+		got, err := ParseTSAP(str)
+		if err != nil || got != want {
+			t.Errorf("ParseTSAP(%q) = %#04x, %v, want %#04x", str, got, err, want)
+		}
+		if back, _ := ParseTSAP(FormatTSAP(got)); back != got {
+			t.Errorf("FormatTSAP(%#04x) = %s does not parse back", got, FormatTSAP(got))
+		}
+	}
+	for _, str := range []string{"", "1.2", "01.023", "0x102", "zz.zz", "-1.02"} {
+		if _, err := ParseTSAP(str); err == nil {
+			t.Errorf("ParseTSAP(%q) accepted", str)
+		}
+	}
+}
+
+// TestRemoteTSAPValue - Zdalny TSAP z typu połączenia, racka i slotu lub jawny
+// ================================================================================================
+func TestRemoteTSAPValue(t *testing.T) {
+	p := PLCConfig{ConnectionType: "PG", Rack: 0, Slot: 2}
+	if got := p.RemoteTSAPValue(); got != 0x0102 {
+		t.Errorf("PG 0/2: %s", FormatTSAP(got))
+	}
+	p = PLCConfig{ConnectionType: "BASIC", Rack: 1, Slot: 4}
+	if got := p.RemoteTSAPValue(); got != 0x0324 {
+		t.Errorf("BASIC 1/4: %s", FormatTSAP(got))
+	}
+	// bez typu połączenia - PG
+	p = PLCConfig{Rack: 7, Slot: 31}
+	if got := p.RemoteTSAPValue(); got != 0x01FF {
+		t.Errorf("7/31: %s", FormatTSAP(got))
+	}
+	// jawny TSAP ma pierwszeństwo przed typem, rackiem i slotem
+	p = PLCConfig{ConnectionType: "OP", Rack: 0, Slot: 3, RemoteTSAP: "10.01"}
+	if got := p.RemoteTSAPValue(); got != 0x1001 {
+		t.Errorf("10.01: %s", FormatTSAP(got))
+	}
+}
+
+// TestConnectAttempt - Opis próby połączenia przy jawnym TSAP spoza PG, OP, BASIC
+// ================================================================================================
+func TestConnectAttempt(t *testing.T) {
+	p := PLCConfig{Address: "127.0.0.1", RemoteTSAP: "10.02", Timeout: time.Second, IdleTimeout: time.Second}
+	_, attempt, err := ConnectPLC(p)
+	if err == nil {
+		t.Skip("S7 server listening on 127.0.0.1")
+	}
+	if attempt.OK || attempt.Error == "" {
+		t.Errorf("failed attempt reported as %+v", attempt)
+	}
+	if attempt.ConnectionType != "TSAP" || attempt.RemoteTSAP != "10.02" || attempt.LocalTSAP != "01.00" {
+		t.Errorf("attempt = %+v", attempt)
+	}
+	if attempt.Rack != 0 || attempt.Slot != 2 {
+		t.Errorf("rack/slot = %d/%d, want 0/2", attempt.Rack, attempt.Slot)
+	}
+}
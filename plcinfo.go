@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robinson/gos7"
+)
+
+// plcInfoDiagEntries - Liczba najnowszych wpisów bufora diagnostycznego odczytywanych z PLC
+const plcInfoDiagEntries = 20
+
+// PLCProtection - Poziom ochrony CPU (SZL 0x0232 indeks 0x0004)
+// ========================================================
+type PLCProtection struct {
+	Level         int    `json:"Level"`         // obowiązujący poziom ochrony (sch_rel)
+	Selector      int    `json:"Selector"`      // poziom ustawiony przełącznikiem (sch_schal)
+	Password      int    `json:"Password"`      // poziom ustawiony hasłem (sch_par, 0 - bez hasła)
+	ModeSwitch    string `json:"ModeSwitch"`    // położenie przełącznika trybu (bart_sch)
+	StartupSwitch string `json:"StartupSwitch"` // położenie przełącznika rozruchu (anl_sch)
+}
+
+// DiagEntry - Wpis bufora diagnostycznego CPU (SZL 0x01A0)
+// ========================================================
+type DiagEntry struct {
+	EventID string `json:"EventID"` // np. 16#4302
+	Time    int64  `json:"Time"`    // czas z zegara PLC
+	Text    string `json:"Text"`
+	Raw     string `json:"Raw"` // cały rekord (hex) do dalszej analizy
+}
+
+// PLCInfo - Identyfikacja i diagnostyka PLC odczytana po połączeniu
+// Errors - odczyty, których sterownik nie obsługuje lub które się nie udały (np. S7-1200/1500 bez PUT/GET)
+// ========================================================
+type PLCInfo struct {
+	Name           string            `json:"Name,omitempty"`
+	Address        string            `json:"Address"`
+	OrderCode      string            `json:"OrderCode"`
+	Firmware       string            `json:"Firmware"`
+	ModuleTypeName string            `json:"ModuleTypeName"`
+	ModuleName     string            `json:"ModuleName"`
+	ASName         string            `json:"ASName"`
+	SerialNumber   string            `json:"SerialNumber"`
+	Copyright      string            `json:"Copyright"`
+	MaxPDU         int               `json:"MaxPDU"`
+	MaxConnections int               `json:"MaxConnections"`
+	CPUState       string            `json:"CPUState"` // RUN, STOP, UNKNOWN
+	Protection     *PLCProtection    `json:"Protection,omitempty"`
+	Diagnostics    []DiagEntry       `json:"Diagnostics"`
+	ReadTime       int64             `json:"ReadTime"`
+	Errors         map[string]string `json:"Errors,omitempty"`
+}
+
+// plcInfos - Ostatnio odczytane informacje o PLC (klucz - adres PLC)
+// ========================================================
+var plcInfos = map[string]*PLCInfo{}
+var plcInfosMutex sync.Mutex
+
+// diagEventClasses - Klasy zdarzeń bufora diagnostycznego (najstarsze 4 bity ID)
+// ========================================================
+var diagEventClasses = map[uint16]string{
+	0x1: "Zdarzenie OB",
+	0x2: "Błąd synchroniczny",
+	0x3: "Błąd asynchroniczny",
+	0x4: "Zmiana trybu pracy",
+	0x5: "Zdarzenie czasu wykonania",
+	0x6: "Zdarzenie komunikacji",
+	0x7: "Zdarzenie systemu F/H",
+	0x8: "Diagnostyka modułu",
+	0x9: "Zdarzenie użytkownika",
+	0xA: "Zdarzenie użytkownika",
+	0xB: "Zdarzenie użytkownika",
+	0xE: "Zdarzenie modułu (nie CPU)",
+	0xF: "Zdarzenie modułu (nie CPU)",
+}
+
+// diagEventTexts - Opisy najczęstszych zdarzeń bufora diagnostycznego
+// ========================================================
+var diagEventTexts = map[uint16]string{
+	0x4301: "Zmiana trybu STOP -> STARTUP",
+	0x4302: "Zmiana trybu STARTUP -> RUN",
+	0x4303: "STOP przełącznikiem trybu",
+	0x4304: "STOP z PG lub SFB 20",
+}
+
+// ReadSZL - Odczyt listy SZL (wszystkie fragmenty odpowiedzi)
+// Zwraca dane rekordów i długość jednego rekordu
+// ================================================================================================
+func ReadSZL(handler *gos7.TCPClientHandler, id uint16, index uint16) ([]byte, int, error) {
+	// telegramy jak w gos7 (readSzl nie jest eksportowane i gubi dane z kolejnych fragmentów)
+	first := []byte{3, 0, 0, 33, 2, 240, 128, 50, 7, 0, 0, 5, 0, 0, 8, 0, 8, 0, 1, 18, 4, 17, 68, 1, 0, 255, 9, 0, 4, 0, 0, 0, 0}
+	next := []byte{3, 0, 0, 33, 2, 240, 128, 50, 7, 0, 0, 6, 0, 0, 12, 0, 4, 0, 1, 18, 8, 18, 68, 1, 1, 0, 0, 0, 0, 10, 0, 0, 0}
+	binary.BigEndian.PutUint16(first[29:], id)
+	binary.BigEndian.PutUint16(first[31:], index)
+
+	var data []byte
+	recordLen := 0
+	request := first
+	for fragment := 0; ; fragment++ {
+		res, err := handler.Send(request)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(res) <= 32 {
+			return nil, 0, errors.New("za krótka odpowiedź SZL")
+		}
+		if binary.BigEndian.Uint16(res[27:]) != 0 && res[29] != 0xFF {
+			return nil, 0, fmt.Errorf("SZL %04X nieobsługiwane przez PLC (kod %04X)", id, binary.BigEndian.Uint16(res[27:]))
+		}
+		size := int(binary.BigEndian.Uint16(res[31:]))
+		start := 37
+		if fragment == 0 {
+			// pierwszy fragment: ID, indeks, długość rekordu i liczba rekordów
+			if len(res) < 41 {
+				return nil, 0, errors.New("za krótka odpowiedź SZL")
+			}
+			recordLen = int(binary.BigEndian.Uint16(res[37:]))
+			size -= 8
+			start = 41
+		}
+		if size < 0 || start+size > len(res) {
+			return nil, 0, errors.New("niepoprawna długość odpowiedzi SZL")
+		}
+		data = append(data, res[start:start+size]...)
+		if res[26] == 0 {
+			return data, recordLen, nil
+		}
+		next[24] = res[24]
+		request = next
+	}
+}
+
+// szlString - Tekst z rekordu SZL (bez zer i spacji na końcu)
+// ================================================================================================
+func szlString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00 ")
+}
+
+// ParseProtection - Poziom ochrony z rekordu SZL 0x0232
+// ================================================================================================
+func ParseProtection(record []byte) (PLCProtection, error) {
+	if len(record) < 12 {
+		return PLCProtection{}, errors.New("za krótki rekord SZL 0x0232")
+	}
+	word := func(pos int) int { return int(binary.BigEndian.Uint16(record[pos:])) }
+	modes := map[int]string{1: "RUN", 2: "RUN-P", 3: "STOP", 4: "MRES"}
+	startups := map[int]string{1: "CRST", 2: "WRST"}
+	p := PLCProtection{Selector: word(2), Password: word(4), Level: word(6), ModeSwitch: modes[word(8)], StartupSwitch: startups[word(10)]}
+	if p.ModeSwitch == "" {
+		p.ModeSwitch = "UNKNOWN"
+	}
+	if p.StartupSwitch == "" {
+		p.StartupSwitch = "UNKNOWN"
+	}
+	return p, nil
+}
+
+// ParseDiagEntries - Wpisy bufora diagnostycznego z rekordów SZL 0x01A0 (najnowszy pierwszy)
+// Rekord: ID zdarzenia (2 bajty), informacje dodatkowe, czas DATE_AND_TIME (BCD, bajty 12..19)
+// ================================================================================================
+func ParseDiagEntries(data []byte, recordLen int) []DiagEntry {
+	entries := []DiagEntry{}
+	if recordLen < 20 {
+		return entries
+	}
+	var helper gos7.Helper
+	for pos := 0; pos+recordLen <= len(data); pos += recordLen {
+		record := data[pos : pos+recordLen]
+		id := binary.BigEndian.Uint16(record)
+		text, ok := diagEventTexts[id]
+		if !ok {
+			text = diagEventClasses[id>>12]
+		}
+		entries = append(entries, DiagEntry{
+			EventID: fmt.Sprintf("16#%04X", id),
+			Time:    helper.GetDateTimeAt(record, 12).UnixNano(),
+			Text:    text,
+			Raw:     hex.EncodeToString(record),
+		})
+	}
+	return entries
+}
+
+// CPUStateText - Stan CPU jako tekst (gos7 PLCGetStatus)
+// ================================================================================================
+func CPUStateText(status int) string {
+	switch status {
+	case 8:
+		return "RUN"
+	case 4:
+		return "STOP"
+	}
+	return "UNKNOWN"
+}
+
+// SafeCall - Wywołanie funkcji gos7 z panic zamienionym na błąd
+// gos7 nie sprawdza długości odpowiedzi SZL, więc krótka odpowiedź kończy się panic
+// ================================================================================================
+func SafeCall(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprint(r))
+		}
+	}()
+	return f()
+}
+
+// ReadPLCInfo - Identyfikacja, stan, ochrona i bufor diagnostyczny PLC
+// Każdy odczyt jest niezależny - brak jednej listy SZL nie blokuje pozostałych
+// ================================================================================================
+func ReadPLCInfo(handler *gos7.TCPClientHandler, p PLCConfig) *PLCInfo {
+	client := gos7.NewClient(handler)
+	info := &PLCInfo{
+		Name:        p.Name,
+		Address:     p.Address,
+		CPUState:    "UNKNOWN",
+		Diagnostics: []DiagEntry{},
+		ReadTime:    time.Now().UnixNano(),
+		Errors:      map[string]string{},
+	}
+
+	read := func(name string, f func() error) {
+		if err := SafeCall(f); err != nil {
+			info.Errors[name] = err.Error()
+		}
+	}
+
+	read("OrderCode", func() error {
+		code, err := client.GetOrderCode()
+		if err == nil {
+			info.OrderCode = szlString([]byte(code.Code))
+			info.Firmware = "V" + strconv.Itoa(int(code.V1)) + "." + strconv.Itoa(int(code.V2)) + "." + strconv.Itoa(int(code.V3))
+		}
+		return err
+	})
+	read("CPUInfo", func() error {
+		cpu, err := client.GetCPUInfo()
+		if err == nil {
+			info.ModuleTypeName = szlString([]byte(cpu.ModuleTypeName))
+			info.ModuleName = szlString([]byte(cpu.ModuleName))
+			info.ASName = szlString([]byte(cpu.ASName))
+			info.SerialNumber = szlString([]byte(cpu.SerialNumber))
+			info.Copyright = szlString([]byte(cpu.Copyright))
+		}
+		return err
+	})
+	read("CPInfo", func() error {
+		cp, err := client.GetCPInfo()
+		if err == nil {
+			info.MaxPDU = cp.MaxPduLength
+			info.MaxConnections = cp.MaxConnections
+		}
+		return err
+	})
+	read("CPUState", func() error {
+		status, err := client.PLCGetStatus()
+		if err == nil {
+			info.CPUState = CPUStateText(status)
+		}
+		return err
+	})
+	read("Protection", func() error {
+		data, _, err := ReadSZL(handler, 0x0232, 0x0004)
+		if err != nil {
+			return err
+		}
+		protection, err := ParseProtection(data)
+		if err == nil {
+			info.Protection = &protection
+		}
+		return err
+	})
+	read("Diagnostics", func() error {
+		data, recordLen, err := ReadSZL(handler, 0x01A0, plcInfoDiagEntries)
+		if err == nil {
+			info.Diagnostics = ParseDiagEntries(data, recordLen)
+		}
+		return err
+	})
+
+	if len(info.Errors) == 0 {
+		info.Errors = nil
+	}
+	return info
+}
+
+// StorePLCInfo - Zapamiętanie informacji o PLC dla endpointu i nagrań
+// ================================================================================================
+func StorePLCInfo(info *PLCInfo) {
+	plcInfosMutex.Lock()
+	defer plcInfosMutex.Unlock()
+	plcInfos[info.Address] = info
+}
+
+// FindPLCInfo - Informacje o PLC po nazwie lub adresie
+// ================================================================================================
+func FindPLCInfo(nameOrAddress string) *PLCInfo {
+	plcInfosMutex.Lock()
+	defer plcInfosMutex.Unlock()
+	return plcInfos[config.FindPLC(nameOrAddress).Address]
+}
+
+// GetPLCInfo - Identyfikacja i diagnostyka PLC (id = nazwa z konfiguracji lub adres)
+// Bez zapisanych informacji lub z refresh=1 łączy się z PLC i odczytuje je na nowo
+// ================================================================================================
+func GetPLCInfo(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetPLCInfo()")
+
+	id := c.Param("id")
+	info := FindPLCInfo(id)
+	if info != nil && c.Query("refresh") != "1" {
+		c.JSON(http.StatusOK, info)
+		return
+	}
+
+	plc := config.FindPLC(id)
+	if err := plc.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	handler, _, err := ConnectPLC(plc)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, "Problem z połączeniem z "+plc.Address)
+		return
+	}
+	defer handler.Close()
+	info = ReadPLCInfo(handler, plc)
+	StorePLCInfo(info)
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RebuildRequest - Parametry przebudowy modelu
+// ========================================================
+type RebuildRequest struct {
+	ComparePrecision int    `json:"ComparePrecision"`
+	PeriodPrecision  int64  `json:"PeriodPrecision"`
+	File             string `json:"File"`
+}
+
+// ModelSummary - Podsumowanie modelu do porównania
+// ========================================================
+type ModelSummary struct {
+	Source           string  `json:"Source"`
+	ComparePrecision int     `json:"ComparePrecision"`
+	PeriodPrecision  int64   `json:"PeriodPrecision"`
+	Images           int     `json:"Images"`
+	States           int     `json:"States"`
+	Transitions      int     `json:"Transitions"`
+	Cycles           []int64 `json:"Cycles"`
+	MaskBits         int     `json:"MaskBits"`
+}
+
+// ModelComparison - Porównanie modelu aktualnego i przebudowanego
+// ========================================================
+type ModelComparison struct {
+	Current       ModelSummary  `json:"Current"`
+	Candidate     *ModelSummary `json:"Candidate"`
+	Running       bool          `json:"Running"`
+	CommonStates  int           `json:"CommonStates"`
+	MaskDiffBits  int           `json:"MaskDiffBits"`
+	CommonEdges   int           `json:"CommonEdges"`
+	OnlyCurrent   int           `json:"OnlyCurrent"`
+	OnlyCandidate int           `json:"OnlyCandidate"`
+}
+
+// candidateModel - Model przebudowany z nowymi parametrami (do porównania przed przełączeniem)
+// Jak model i rebuildRunning - tylko pod modelMutex
+// ========================================================
+var candidateModel *Model
+
+// rebuildRunning - Trwa przebudowa modelu
+// ========================================================
+var rebuildRunning bool
+
+// Summary - Podsumowanie modelu
+// ================================================================================================
+func (m *Model) Summary() ModelSummary {
+	bits := 0
+	for _, b := range m.maskImage {
+		for ; b != 0; b &= b - 1 {
+			bits++
+		}
+	}
+	return ModelSummary{
+		Source:           m.Source,
+		ComparePrecision: m.ComparePrecision,
+		PeriodPrecision:  m.PeriodPrecision,
+		Images:           m.writeID,
+		States:           len(m.machineStates),
+		Transitions:      len(m.Transisions),
+		Cycles:           m.cyclesFound,
+		MaskBits:         bits,
+	}
+}
+
+// CompareModels - Porównanie dwóch modeli (wspólne stany i krawędzie grafu)
+// ================================================================================================
+func CompareModels(current *Model, candidate *Model) ModelComparison {
+	cmp := ModelComparison{Current: current.Summary()}
+	if candidate == nil {
+		return cmp
+	}
+	summary := candidate.Summary()
+	cmp.Candidate = &summary
+
+	for i := 0; i < imageSize; i++ {
+		for b := current.maskImage[i] ^ candidate.maskImage[i]; b != 0; b &= b - 1 {
+			cmp.MaskDiffBits++
+		}
+	}
+
+	// numery stanów kandydata odpowiadające stanom aktualnego modelu
+	mapping := make([]int, len(current.machineStates))
+	for k, state := range current.machineStates {
+		mapping[k] = candidate.FindState(state)
+		if mapping[k] >= 0 {
+			cmp.CommonStates++
+		}
+	}
+	cmp.OnlyCurrent = len(current.machineStates) - cmp.CommonStates
+	cmp.OnlyCandidate = len(candidate.machineStates) - cmp.CommonStates
+
+	for _, trans := range current.Transisions {
+		src, dst := mapping[trans.StateNrSrc], mapping[trans.StateNrDst]
+		if src < 0 || dst < 0 {
+			continue
+		}
+		for _, trans2 := range candidate.Transisions {
+			if trans2.StateNrSrc == src && trans2.StateNrDst == dst {
+				cmp.CommonEdges++
+				break
+			}
+		}
+	}
+	return cmp
+}
+
+// PostRebuild - Przebudowa modelu z nowymi parametrami (w tle)
+// ================================================================================================
+func PostRebuild(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PostRebuild()")
+
+	modelMutex.RLock()
+	req := RebuildRequest{
+		ComparePrecision: model.ComparePrecision,
+		PeriodPrecision:  model.PeriodPrecision,
+	}
+	modelMutex.RUnlock()
+	// puste body - przebudowa z aktualnymi parametrami
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// nagranie tylko po nazwie z katalogu nagrań (bez dostępu do innych plików serwera)
+	var rec *Recording
+	source := "live"
+	if req.File != "" {
+		path, err := RecordingPath(config.Recordings, req.File)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := LoadRecordingData(path)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, err.Error())
+			return
+		}
+		rec = &data
+		source = req.File
+	}
+	timeline := machineTimeline
+
+	modelMutex.Lock()
+	if rebuildRunning {
+		modelMutex.Unlock()
+		c.JSON(http.StatusConflict, "Przebudowa modelu już trwa")
+		return
+	}
+	rebuildRunning = true
+	modelMutex.Unlock()
+	go func() {
+		var m *Model
+		if rec != nil {
+			m = BuildRecordingModel(*rec, req.ComparePrecision, req.PeriodPrecision)
+		} else {
+			m = BuildModel(timeline, req.ComparePrecision, req.PeriodPrecision)
+		}
+		m.Source = source
+		modelMutex.Lock()
+		candidateModel = m
+		rebuildRunning = false
+		modelMutex.Unlock()
+		log.Println("Model rebuilt from", source, "-", len(m.machineStates), "states,", len(m.Transisions), "transitions")
+	}()
+
+	c.JSON(http.StatusAccepted, req)
+}
+
+// GetModelCompare - Porównanie modelu aktualnego z przebudowanym
+// ================================================================================================
+func GetModelCompare(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetModelCompare()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	cmp := CompareModels(model, candidateModel)
+	cmp.Running = rebuildRunning
+	c.JSON(http.StatusOK, cmp)
+}
+
+// PostModelSwitch - Przełączenie na model przebudowany
+// ================================================================================================
+func PostModelSwitch(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PostModelSwitch()")
+
+	modelMutex.Lock()
+	defer modelMutex.Unlock()
+	m := candidateModel
+	if m == nil {
+		c.JSON(http.StatusNotFound, "Brak przebudowanego modelu")
+		return
+	}
+	// model z pliku nie odpowiada obrazom z aktualnego timeline
+	if m.Source != "live" {
+		c.JSON(http.StatusConflict, "Model z pliku "+m.Source+" służy tylko do porównania")
+		return
+	}
+
+	model = m
+	candidateModel = nil
+	if len(m.cyclesFound) > 0 && etap == "AnalyzeCycles" {
+		etap = "AnalyzeWrite"
+	}
+	c.JSON(http.StatusOK, m.Summary())
+}
+
+// DeleteModelCandidate - Odrzucenie przebudowanego modelu
+// ================================================================================================
+func DeleteModelCandidate(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("DeleteModelCandidate()")
+
+	modelMutex.Lock()
+	candidateModel = nil
+	modelMutex.Unlock()
+	c.JSON(http.StatusOK, "OK")
+}
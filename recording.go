@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordingLine - Linia nagrania: obraz, nagłówek z informacjami o PLC (pierwsza linia)
+// albo zmiana stanu CPU (RUN/STOP) wpisana między obrazy
+// ========================================================
+type recordingLine struct {
+	MachineImage
+	PLC *PLCInfo        `json:"PLC,omitempty"`
+	CPU *CPUStateChange `json:"CPU,omitempty"`
+}
+
+// Recording - Odczytane nagranie
+// ========================================================
+type Recording struct {
+	PLC      *PLCInfo // nil dla starszych nagrań
+	CPU      []CPUStateChange
+	Timeline []MachineImage
+}
+
+// WriteRecording - Zapis timeline jako nagranie (JSON lines - jeden obraz w linii)
+// Przy znanym PLC pierwsza linia to nagłówek {"PLC": {...}} wiążący nagranie ze sterownikiem i firmware,
+// zmiany stanu CPU są zapisane jako {"CPU": {...}} przed pierwszym obrazem po zmianie
+// ================================================================================================
+func WriteRecording(w io.Writer, info *PLCInfo, cpu []CPUStateChange, timeline []MachineImage) error {
+	enc := json.NewEncoder(w)
+	if info != nil {
+		if err := enc.Encode(struct {
+			PLC *PLCInfo `json:"PLC"`
+		}{info}); err != nil {
+			return err
+		}
+	}
+	type cpuLine struct {
+		CPU CPUStateChange `json:"CPU"`
+	}
+	for _, image := range timeline {
+		for len(cpu) > 0 && cpu[0].Time <= image.Timestamp {
+			if err := enc.Encode(cpuLine{cpu[0]}); err != nil {
+				return err
+			}
+			cpu = cpu[1:]
+		}
+		if err := enc.Encode(image); err != nil {
+			return err
+		}
+	}
+	for _, change := range cpu {
+		if err := enc.Encode(cpuLine{change}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRecording - Odczyt nagrania timeline
+// ================================================================================================
+func ReadRecording(r io.Reader) ([]MachineImage, error) {
+	rec, err := ReadRecordingData(r)
+	return rec.Timeline, err
+}
+
+// ReadRecordingData - Odczyt nagrania z informacjami o PLC i zmianami stanu CPU
+// ================================================================================================
+func ReadRecordingData(r io.Reader) (Recording, error) {
+	var rec Recording
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var line recordingLine
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			return rec, nil
+		}
+		if err != nil {
+			return Recording{}, err
+		}
+		switch {
+		case line.PLC != nil:
+			rec.PLC = line.PLC
+		case line.CPU != nil:
+			rec.CPU = append(rec.CPU, *line.CPU)
+		default:
+			rec.Timeline = append(rec.Timeline, line.MachineImage)
+		}
+	}
+}
+
+// LoadRecording - Odczyt nagrania timeline z pliku
+// ================================================================================================
+func LoadRecording(path string) ([]MachineImage, error) {
+	rec, err := LoadRecordingData(path)
+	return rec.Timeline, err
+}
+
+// LoadRecordingData - Odczyt nagrania z pliku z informacjami o PLC i zmianami stanu CPU
+// ================================================================================================
+func LoadRecordingData(path string) (Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Recording{}, err
+	}
+	defer f.Close()
+	return ReadRecordingData(f)
+}
+
+// RecordingPath - Ścieżka nagrania z katalogu nagrań (config.Recordings)
+// Przyjmowana jest tylko sama nazwa pliku - ścieżki i dowiązania poza katalog są odrzucane
+// ================================================================================================
+func RecordingPath(dir string, name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errors.New("niepoprawna nazwa nagrania " + name)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", errors.New("brak katalogu nagrań " + dir)
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", errors.New("nie znaleziono nagrania " + name)
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel != filepath.Base(rel) || rel == ".." {
+		return "", errors.New("nagranie " + name + " poza katalogiem nagrań")
+	}
+	return path, nil
+}
+
+// GetRecording - Pobranie aktualnego timeline jako nagrania
+// ================================================================================================
+func GetRecording(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetRecording()")
+
+	name := "s7-" + strconv.FormatInt(time.Now().Unix(), 10) + ".jsonl"
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", "attachment; filename="+name)
+	c.Status(http.StatusOK)
+	ErrCheck(WriteRecording(c.Writer, FindPLCInfo(plcAddress), CPUChanges(0, math.MaxInt64), machineTimeline))
+}
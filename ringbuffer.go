@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robinson/gos7"
+)
+
+// PLCBufferConfig - Bufor zdarzeń w DB, do którego FB w PLC zapisuje każdą zmianę obrazu ze znacznikiem czasu
+// Index - UDINT pod IndexOffset: licznik zapisanych wpisów (wpis n leży na pozycji n mod Entries),
+// przy IndexType "position" pozycja następnego zapisu (wtedy przepełnienia bufora nie da się wykryć)
+// Wpis - znacznik czasu (TimeType: ticks, dtl, dt) i ImageLength bajtów obrazu od ImageStart (0 = MB0, 128 = EB0, 256 = AB0)
+// EntrySize - rozmiar wpisu w DB (domyślnie znacznik + obraz wyrównane do słowa)
+// ========================================================
+type PLCBufferConfig struct {
+	DB            int    `yaml:"db" json:"DB"`
+	IndexOffset   int    `yaml:"index_offset" json:"IndexOffset"`
+	IndexType     string `yaml:"index_type" json:"IndexType"`
+	EntriesOffset int    `yaml:"entries_offset" json:"EntriesOffset"`
+	Entries       int    `yaml:"entries" json:"Entries"`
+	EntrySize     int    `yaml:"entry_size,omitempty" json:"EntrySize,omitempty"`
+	TimeType      string `yaml:"time_type" json:"TimeType"`
+	ImageStart    int    `yaml:"image_start" json:"ImageStart"`
+	ImageLength   int    `yaml:"image_length" json:"ImageLength"`
+}
+
+// Validate - Sprawdzenie układu bufora
+// ================================================================================================
+func (b *PLCBufferConfig) Validate(name string) error {
+	b.IndexType = strings.ToLower(b.IndexType)
+	if b.IndexType == "" {
+		b.IndexType = "counter"
+	}
+	b.TimeType = strings.ToLower(b.TimeType)
+	switch {
+	case b.DB < 1 || b.DB > 65535 || b.IndexOffset < 0 || b.EntriesOffset < 0:
+		return errors.New("niepoprawny adres bufora DB" + strconv.Itoa(b.DB) + " dla PLC " + name)
+	case b.IndexType != "counter" && b.IndexType != "position":
+		return errors.New("nieznany typ indeksu bufora " + b.IndexType + " (counter, position) dla PLC " + name)
+	case b.Entries < 2:
+		return errors.New("bufor musi mieć co najmniej 2 wpisy dla PLC " + name)
+	case b.TimeType != "ticks" && b.TimeType != "dtl" && b.TimeType != "dt":
+		return errors.New("nieznany typ znacznika czasu bufora " + b.TimeType + " (ticks, dtl, dt) dla PLC " + name)
+	case b.ImageStart < 0 || b.ImageLength < 1 || b.ImageStart+b.ImageLength > imageSize:
+		return errors.New("niepoprawny fragment obrazu w buforze (0.." + strconv.Itoa(imageSize) + ") dla PLC " + name)
+	}
+	min := plcClockSizes[b.TimeType] + b.ImageLength
+	if b.EntrySize == 0 {
+		b.EntrySize = min + min%2
+	}
+	if b.EntrySize < min {
+		return errors.New("za mały rozmiar wpisu bufora (min " + strconv.Itoa(min) + ") dla PLC " + name)
+	}
+	return nil
+}
+
+// BufferStats - Stan odczytu bufora zdarzeń w sesji
+// ========================================================
+type BufferStats struct {
+	Config   PLCBufferConfig `json:"Config"`
+	Index    uint32          `json:"Index"`
+	Entries  int64           `json:"Entries"`  // odczytane wpisy
+	Lost     int64           `json:"Lost"`     // wpisy nadpisane przed odczytem (za wolny odczyt lub za mały bufor)
+	Batches  int             `json:"Batches"`  // odczyty z nowymi wpisami
+	MaxBatch int             `json:"MaxBatch"` // najwięcej nowych wpisów w jednym odczycie
+}
+
+// ringReader - Odczyt nowych wpisów bufora zdarzeń i odtwarzanie z nich timeline
+// ========================================================
+type ringReader struct {
+	cfg      PLCBufferConfig
+	session  string
+	started  bool
+	timed    bool
+	anchored bool
+	last     uint32
+	lastTick uint32
+	plcTime  int64 // zegar wpisów dla "ticks", dla "dtl" i "dt" ostatni poprawny czas [ns]
+	shift    int64 // czas serwera minus zegar PLC (z pierwszego odczytu)
+	image    [imageSize]byte
+	stats    BufferStats
+}
+
+// sessionBuffer - Bufor zdarzeń aktualnej sesji (nil - zwykły odczyt obszarów)
+// ========================================================
+var sessionBuffer *ringReader
+var bufferMutex sync.Mutex
+
+// StartRingReader - Nowa sesja z buforem zdarzeń
+// ================================================================================================
+func StartRingReader(session string, cfg *PLCBufferConfig) *ringReader {
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	sessionBuffer = nil
+	if cfg != nil {
+		sessionBuffer = &ringReader{cfg: *cfg, session: session, stats: BufferStats{Config: *cfg}}
+	}
+	return sessionBuffer
+}
+
+// Read - Nowe wpisy od poprzedniego odczytu jako obrazy (pierwszy odczyt tylko ustala pozycję)
+// readStart - czas serwera początku odczytu, do niego przypisany jest najnowszy wpis pierwszego odczytu
+// ================================================================================================
+func (r *ringReader) Read(client gos7.Client, readStart int64) ([]MachineImage, error) {
+	index, err := r.readIndex(client)
+	if err != nil {
+		return nil, err
+	}
+	if !r.started {
+		r.started = true
+		r.last = index
+		return nil, nil
+	}
+
+	entries := int64(r.cfg.Entries)
+	var count int64
+	if r.cfg.IndexType == "counter" {
+		count = int64(index - r.last)
+	} else {
+		count = (int64(index) - int64(r.last) + entries) % entries
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	// najstarszy wpis może być właśnie nadpisywany - czytamy najwyżej Entries-1 wpisów
+	var lost int64
+	if count > entries-1 {
+		lost = count - (entries - 1)
+		count = entries - 1
+	}
+	first := (int64(index) - count) % entries
+	if first < 0 {
+		first += entries
+	}
+
+	data := make([]byte, count*int64(r.cfg.EntrySize))
+	for done := int64(0); done < count; {
+		pos := (first + done) % entries
+		n := count - done
+		if pos+n > entries {
+			n = entries - pos
+		}
+		chunk := data[done*int64(r.cfg.EntrySize) : (done+n)*int64(r.cfg.EntrySize)]
+		if err := client.AGReadDB(r.cfg.DB, r.cfg.EntriesOffset+int(pos)*r.cfg.EntrySize, len(chunk), chunk); err != nil {
+			return nil, err
+		}
+		done += n
+	}
+
+	// wpisy nadpisane w trakcie odczytu (licznik wpisów poszedł dalej niż bufor) są odrzucane
+	skip := int64(0)
+	if r.cfg.IndexType == "counter" {
+		if after, err := r.readIndex(client); err == nil {
+			if over := int64(after-index) - (entries - 1 - count); over > 0 {
+				skip = over
+				if skip > count {
+					skip = count
+				}
+			}
+		}
+	}
+	lost += skip
+
+	images := make([]MachineImage, 0, count-skip)
+	size := plcClockSizes[r.cfg.TimeType]
+	for i := skip; i < count; i++ {
+		entry := data[i*int64(r.cfg.EntrySize) : (i+1)*int64(r.cfg.EntrySize)]
+		image := MachineImage{IOImage: r.image}
+		copy(image.IOImage[r.cfg.ImageStart:r.cfg.ImageStart+r.cfg.ImageLength], entry[size:size+r.cfg.ImageLength])
+		if r.cfg.TimeType == "ticks" {
+			tick := uint32(PLCTimeValue("ticks", entry))
+			if r.timed {
+				r.plcTime += TicksDelta(r.lastTick, tick)
+			}
+			r.lastTick, r.timed = tick, true
+			image.PLCTime = r.plcTime
+		} else {
+			// niepoprawna data we wpisie - czas poprzedniego wpisu, zachowuje kolejność
+			if t := PLCTimeValue(r.cfg.TimeType, entry); t != 0 {
+				r.plcTime = t
+			}
+			image.PLCTime = r.plcTime
+		}
+		images = append(images, image)
+		r.image = image.IOImage
+	}
+
+	// zegar PLC na czas serwera - najnowszy wpis pierwszego odczytu to chwila odczytu
+	// (przybliżenie od dołu - wpis powstał przed odczytem)
+	if len(images) > 0 && !r.anchored {
+		r.shift = readStart - images[len(images)-1].PLCTime
+		r.anchored = true
+	}
+	for i := range images {
+		images[i].Timestamp = images[i].PLCTime + r.shift
+		if r.cfg.TimeType == "ticks" {
+			// zegar "ticks" nie ma własnego początku - liczony w czasie serwera
+			images[i].PLCTime = images[i].Timestamp
+		}
+	}
+
+	r.last = index
+	bufferMutex.Lock()
+	r.stats.Index = index
+	r.stats.Entries += int64(len(images))
+	r.stats.Lost += lost
+	r.stats.Batches++
+	if int(count) > r.stats.MaxBatch {
+		r.stats.MaxBatch = int(count)
+	}
+	bufferMutex.Unlock()
+	metricBufferEntries.WithLabelValues(r.session).Add(float64(len(images)))
+	if lost > 0 {
+		metricBufferLost.WithLabelValues(r.session).Add(float64(lost))
+		log.Println("Bufor zdarzeń", r.session, "- utracone wpisy:", lost)
+	}
+	return images, nil
+}
+
+// Break - Przerwa w odczytach (STOP CPU) - licznik wpisów i TIME_TCK mogły się wyzerować
+// ================================================================================================
+func (r *ringReader) Break() {
+	r.started, r.timed, r.anchored = false, false, false
+}
+
+// readIndex - Odczyt indeksu zapisu bufora
+// ================================================================================================
+func (r *ringReader) readIndex(client gos7.Client) (uint32, error) {
+	buf := make([]byte, 4)
+	if err := client.AGReadDB(r.cfg.DB, r.cfg.IndexOffset, 4, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// GetPLCBuffer - Stan odczytu bufora zdarzeń PLC
+// ================================================================================================
+func GetPLCBuffer(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetPLCBuffer()")
+
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	if sessionBuffer == nil {
+		c.JSON(http.StatusNotFound, "Bufor zdarzeń PLC nie jest skonfigurowany")
+		return
+	}
+	c.JSON(http.StatusOK, sessionBuffer.stats)
+}
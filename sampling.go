@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pollScheduler - Odczyty ze stałą częstotliwością (okres liczony od początku do początku odczytu)
+// Czas odczytu jest odejmowany od czekania; gdy odczyt trwa dłużej niż okres, pominięte takty są liczone
+// ========================================================
+type pollScheduler struct {
+	period   time.Duration
+	next     int64
+	overruns int
+}
+
+// Wait - Czekanie na kolejny takt
+// ================================================================================================
+func (s *pollScheduler) Wait() {
+	if s.period <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	if s.next == 0 {
+		s.next = now
+	}
+	if now < s.next {
+		time.Sleep(time.Duration(s.next - now))
+	} else if late := now - s.next; late >= int64(s.period) {
+		missed := late / int64(s.period)
+		s.overruns += int(missed)
+		metricPollOverruns.WithLabelValues(plcAddress).Add(float64(missed))
+		s.next += missed * int64(s.period)
+	}
+	s.next += int64(s.period)
+}
+
+// JitterStats - Statystyki próbkowania sesji [ms]
+// Uncertainty - połowa 95% przedziału ufności zmierzonego czasu przejścia (czas ± Uncertainty)
+// ========================================================
+type JitterStats struct {
+	Samples     int     `json:"Samples"`
+	Period      float64 `json:"Period"` // średni okres między obrazami
+	Jitter      float64 `json:"Jitter"` // odchylenie standardowe okresu
+	MinPeriod   float64 `json:"MinPeriod"`
+	MaxPeriod   float64 `json:"MaxPeriod"`
+	ReadMean    float64 `json:"ReadMean"` // średni czas odczytu obrazu
+	ReadMax     float64 `json:"ReadMax"`
+	Overruns    int     `json:"Overruns"` // pominięte takty harmonogramu
+	Uncertainty int64   `json:"Uncertainty"`
+}
+
+// jitterTracker - Liczenie statystyk próbkowania (średnia i wariancja metodą Welforda)
+// ========================================================
+type jitterTracker struct {
+	last    int64
+	n       int
+	mean    float64
+	m2      float64
+	min     float64
+	max     float64
+	reads   int
+	readSum float64
+	readMax float64
+}
+
+// Add - Nowy obraz (okres liczony od poprzedniego obrazu)
+// ================================================================================================
+func (j *jitterTracker) Add(image MachineImage) {
+	// obraz z bufora zdarzeń PLC - czas z zegara PLC, nie z odczytu (odstępy to zmiany, nie próbkowanie)
+	if image.ReadEnd == 0 && image.PLCTime != 0 {
+		return
+	}
+	if image.ReadEnd > image.ReadStart {
+		read := float64(image.ReadEnd-image.ReadStart) / 1e6
+		j.reads++
+		j.readSum += read
+		j.readMax = math.Max(j.readMax, read)
+	}
+	if j.last > 0 && image.Timestamp > j.last {
+		period := float64(image.Timestamp-j.last) / 1e6
+		j.n++
+		delta := period - j.mean
+		j.mean += delta / float64(j.n)
+		j.m2 += delta * (period - j.mean)
+		if j.n == 1 || period < j.min {
+			j.min = period
+		}
+		j.max = math.Max(j.max, period)
+	}
+	j.last = image.Timestamp
+}
+
+// Break - Przerwa w próbkowaniu (np. STOP CPU) - następny okres nie jest liczony
+// ================================================================================================
+func (j *jitterTracker) Break() {
+	j.last = 0
+}
+
+// Stats - Aktualne statystyki
+// ================================================================================================
+func (j *jitterTracker) Stats() JitterStats {
+	s := JitterStats{Samples: j.n, Period: j.mean, MinPeriod: j.min, MaxPeriod: j.max, ReadMax: j.readMax}
+	if j.n > 1 {
+		s.Jitter = math.Sqrt(j.m2 / float64(j.n-1))
+	}
+	if j.reads > 0 {
+		s.ReadMean = j.readSum / float64(j.reads)
+	}
+	s.Uncertainty = j.Uncertainty()
+	return s
+}
+
+// Uncertainty - Połowa 95% przedziału ufności czasu przejścia [ms]
+// Każde zbocze przejścia jest wykryte do jednego okresu po fakcie, więc różnica dwóch zboczy
+// ma błąd do ± okres (średni okres + 2 odchylenia standardowe), a chwila odczytu obrazu
+// w obrębie odczytu to ± połowa czasu odczytu dla każdego z dwóch obrazów
+// ================================================================================================
+func (j *jitterTracker) Uncertainty() int64 {
+	if j.n == 0 {
+		return 0
+	}
+	s := j.mean
+	if j.n > 1 {
+		s += 2 * math.Sqrt(j.m2/float64(j.n-1))
+	}
+	if j.reads > 0 {
+		s += j.readSum / float64(j.reads)
+	}
+	return int64(math.Ceil(s))
+}
+
+// sessionJitter - Statystyki próbkowania aktualnej sesji
+// ========================================================
+var sessionJitter jitterTracker
+var sessionOverruns int
+var jitterMutex sync.Mutex
+
+// ResetJitter - Nowa sesja - statystyki od zera
+// ================================================================================================
+func ResetJitter() {
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	sessionJitter = jitterTracker{}
+	sessionOverruns = 0
+}
+
+// TrackJitter - Obraz z pętli odczytu w statystykach sesji
+// ================================================================================================
+func TrackJitter(image MachineImage, overruns int) {
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	if sessionJitter.last > 0 && image.Timestamp > sessionJitter.last {
+		metricPollInterval.WithLabelValues(plcAddress).Observe(float64(image.Timestamp-sessionJitter.last) / 1e9)
+	}
+	sessionJitter.Add(image)
+	sessionOverruns = overruns
+}
+
+// BreakJitter - Przerwa w próbkowaniu sesji
+// ================================================================================================
+func BreakJitter() {
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	sessionJitter.Break()
+}
+
+// SessionJitter - Statystyki próbkowania sesji
+// ================================================================================================
+func SessionJitter() JitterStats {
+	jitterMutex.Lock()
+	defer jitterMutex.Unlock()
+	s := sessionJitter.Stats()
+	s.Overruns = sessionOverruns
+	return s
+}
+
+// UpdateJitter - Statystyki próbkowania timeline modelu (nowe obrazy od ostatniego przebiegu)
+// Obrazy rozdzielone przez STOP CPU nie tworzą okresu
+// ================================================================================================
+func (m *Model) UpdateJitter(timeline []MachineImage) {
+	for i := m.jitterID; i < len(timeline); i++ {
+		if i > 0 && m.StopBetween(timeline[i-1].Timestamp, timeline[i].Timestamp) {
+			m.jitter.Break()
+		}
+		m.jitter.Add(timeline[i])
+	}
+	m.jitterID = len(timeline)
+}
+
+// GetSampling - Statystyki próbkowania sesji (okres, jitter, czas odczytu, niepewność czasów przejść)
+// ================================================================================================
+func GetSampling(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetSampling()")
+
+	c.JSON(http.StatusOK, SessionJitter())
+}
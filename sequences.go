@@ -0,0 +1,312 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parametry szukania sekwencji - domyślne wartości zapytania
+const sequenceMinLen = 2
+const sequenceMaxLen = 6
+const sequenceMaxLenLimit = 20
+const sequenceMinSupport = 3
+const sequenceRareShare = 0.05
+const sequenceLimit = 50
+
+// sequenceMaxTimes - Ile chwil wystąpienia wariantu zwracamy (do odszukania w timeline)
+const sequenceMaxTimes = 10
+
+// StateVisit - Pobyt maszyny w stanie (kolejne obrazy z tym samym stanem)
+// Start - chwila pierwszego obrazu stanu, End - chwila pierwszego obrazu następnego stanu
+// (dla ostatniego pobytu odcinka - ostatni obraz) [ns]
+// ========================================================
+type StateVisit struct {
+	State  int   `json:"State"`
+	Start  int64 `json:"Start"`
+	End    int64 `json:"End"`
+	Images int   `json:"Images"`
+}
+
+// StatePattern - Często powtarzany łańcuch kroków (kolejnych stanów)
+// Duration - typowy (mediana) czas łańcucha od wejścia w pierwszy do wyjścia z ostatniego stanu [ms]
+// ========================================================
+type StatePattern struct {
+	Steps       []int `json:"Steps"`
+	Support     int   `json:"Support"`
+	Duration    int64 `json:"Duration"`
+	DurationMin int64 `json:"DurationMin"`
+	DurationMax int64 `json:"DurationMax"`
+	Last        int64 `json:"Last"` // początek ostatniego wystąpienia [ns]
+}
+
+// SequenceVariant - Rzadki wariant częstego łańcucha (po częstym początku inny niż zwykle krok)
+// Może wskazywać ręczną interwencję lub usterkę
+// ========================================================
+type SequenceVariant struct {
+	Steps   []int   `json:"Steps"`
+	Support int     `json:"Support"`
+	Share   float64 `json:"Share"`  // udział wśród wszystkich kontynuacji tego samego początku
+	Common  []int   `json:"Common"` // najczęstsza kontynuacja tego samego początku
+	Times   []int64 `json:"Times"`  // początki wystąpień [ns]
+}
+
+// SequenceReport - Wynik szukania częstych sekwencji kroków
+// ========================================================
+type SequenceReport struct {
+	Visits     int               `json:"Visits"`
+	MinLen     int               `json:"MinLen"`
+	MaxLen     int               `json:"MaxLen"`
+	MinSupport int               `json:"MinSupport"`
+	Patterns   []StatePattern    `json:"Patterns"`
+	Variants   []SequenceVariant `json:"Variants"`
+}
+
+// sequenceChain - Wystąpienia łańcucha kroków
+// ========================================================
+type sequenceChain struct {
+	steps     []int
+	durations []int64
+	times     []int64
+}
+
+// StateVisits - Timeline jako ciąg pobytów w stanach modelu
+// Odcinki są rozdzielone przez STOP CPU i obrazy spoza nauczonych stanów (ciąg kroków nie jest tam ciągły)
+// ================================================================================================
+func (m *Model) StateVisits(timeline []MachineImage) [][]StateVisit {
+	var segments [][]StateVisit
+	var visits []StateVisit
+	var previous [imageSize]byte
+	state := -1
+
+	for i, image := range timeline {
+		masked := MaskedImage(image.IOImage, m.maskImage)
+		if i > 0 && m.StopBetween(timeline[i-1].Timestamp, image.Timestamp) {
+			state = -1
+			if len(visits) > 0 {
+				segments = append(segments, visits)
+				visits = nil
+			}
+		} else if i > 0 && state >= 0 && ImageCompare(masked, previous) == 0 {
+			visits[len(visits)-1].End = ImageTime(image)
+			visits[len(visits)-1].Images++
+			continue
+		}
+		previous = masked
+
+		state = m.FindState(masked)
+		if state < 0 {
+			if len(visits) > 0 {
+				segments = append(segments, visits)
+				visits = nil
+			}
+			continue
+		}
+		if len(visits) > 0 {
+			visits[len(visits)-1].End = ImageTime(image)
+		}
+		visits = append(visits, StateVisit{State: state, Start: ImageTime(image), End: ImageTime(image), Images: 1})
+	}
+	if len(visits) > 0 {
+		segments = append(segments, visits)
+	}
+	return segments
+}
+
+// sequenceKey - Klucz łańcucha kroków
+// ================================================================================================
+func sequenceKey(steps []int) string {
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		parts[i] = strconv.Itoa(step)
+	}
+	return strings.Join(parts, "-")
+}
+
+// MineSequences - Częste łańcuchy kroków długości minLen..maxLen (n-gramy ciągu pobytów)
+// Zwracane są tylko łańcuchy zamknięte - bez dłuższego łańcucha o tym samym wsparciu,
+// który je zawiera, oraz rzadkie warianty (udział poniżej rareShare) po częstym początku
+// ================================================================================================
+func MineSequences(segments [][]StateVisit, minLen int, maxLen int, minSupport int, rareShare float64) SequenceReport {
+	report := SequenceReport{MinLen: minLen, MaxLen: maxLen, MinSupport: minSupport, Patterns: []StatePattern{}, Variants: []SequenceVariant{}}
+
+	// wszystkie łańcuchy długości 1..maxLen+1 (dłuższe o jeden - do sprawdzenia zamkniętości)
+	chains := map[string]*sequenceChain{}
+	for _, visits := range segments {
+		report.Visits += len(visits)
+		for start := range visits {
+			for n := 1; n <= maxLen+1 && start+n <= len(visits); n++ {
+				steps := make([]int, n)
+				for i := range steps {
+					steps[i] = visits[start+i].State
+				}
+				key := sequenceKey(steps)
+				chain, ok := chains[key]
+				if !ok {
+					chain = &sequenceChain{steps: steps}
+					chains[key] = chain
+				}
+				chain.durations = append(chain.durations, (visits[start+n-1].End-visits[start].Start)/1000000)
+				chain.times = append(chain.times, visits[start].Start)
+			}
+		}
+	}
+
+	// najwyższe wsparcie łańcucha dłuższego o jeden krok (na początku lub na końcu)
+	extended := map[string]int{}
+	for _, chain := range chains {
+		n := len(chain.steps)
+		if n < 2 {
+			continue
+		}
+		for _, key := range []string{sequenceKey(chain.steps[:n-1]), sequenceKey(chain.steps[1:])} {
+			if len(chain.times) > extended[key] {
+				extended[key] = len(chain.times)
+			}
+		}
+	}
+
+	// kontynuacje łańcuchów - najczęstsza i wszystkie
+	continuations := map[string][]*sequenceChain{}
+	for _, chain := range chains {
+		n := len(chain.steps)
+		if n < minLen || n > maxLen {
+			continue
+		}
+		support := len(chain.times)
+		if support >= minSupport && extended[sequenceKey(chain.steps)] < support {
+			durations := append([]int64(nil), chain.durations...)
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			report.Patterns = append(report.Patterns, StatePattern{
+				Steps:       chain.steps,
+				Support:     support,
+				Duration:    durations[len(durations)/2],
+				DurationMin: durations[0],
+				DurationMax: durations[len(durations)-1],
+				Last:        chain.times[len(chain.times)-1],
+			})
+		}
+		if n > 1 {
+			prefix := sequenceKey(chain.steps[:n-1])
+			continuations[prefix] = append(continuations[prefix], chain)
+		}
+	}
+
+	for prefix, list := range continuations {
+		if len(chains[prefix].times) < minSupport || len(list) < 2 {
+			continue
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if len(list[i].times) != len(list[j].times) {
+				return len(list[i].times) > len(list[j].times)
+			}
+			return sequenceKey(list[i].steps) < sequenceKey(list[j].steps)
+		})
+		common := list[0]
+		total := 0
+		for _, chain := range list {
+			total += len(chain.times)
+		}
+		for _, chain := range list {
+			share := float64(len(chain.times)) / float64(total)
+			if chain == common || share >= rareShare {
+				continue
+			}
+			times := chain.times
+			if len(times) > sequenceMaxTimes {
+				times = times[:sequenceMaxTimes]
+			}
+			report.Variants = append(report.Variants, SequenceVariant{
+				Steps:   chain.steps,
+				Support: len(chain.times),
+				Share:   share,
+				Common:  common.steps,
+				Times:   times,
+			})
+		}
+	}
+
+	// to samo odstępstwo w dłuższym kontekście pomijamy - zostaje najkrótszy wariant
+	rare := map[string]bool{}
+	for _, variant := range report.Variants {
+		rare[sequenceKey(variant.Steps)] = true
+	}
+	variants := report.Variants[:0]
+	for _, variant := range report.Variants {
+		if !rare[sequenceKey(variant.Steps[1:])] {
+			variants = append(variants, variant)
+		}
+	}
+	report.Variants = variants
+
+	// najpierw najczęstsze, przy równym wsparciu najdłuższe
+	sort.Slice(report.Patterns, func(i, j int) bool {
+		a, b := report.Patterns[i], report.Patterns[j]
+		if a.Support != b.Support {
+			return a.Support > b.Support
+		}
+		if len(a.Steps) != len(b.Steps) {
+			return len(a.Steps) > len(b.Steps)
+		}
+		return sequenceKey(a.Steps) < sequenceKey(b.Steps)
+	})
+	sort.Slice(report.Variants, func(i, j int) bool {
+		a, b := report.Variants[i], report.Variants[j]
+		if a.Share != b.Share {
+			return a.Share < b.Share
+		}
+		return sequenceKey(a.Steps) < sequenceKey(b.Steps)
+	})
+	return report
+}
+
+// GetSequences - Częste sekwencje kroków maszyny i ich rzadkie warianty
+// (minLen, maxLen, minSupport, rare - próg udziału wariantu, limit)
+// ================================================================================================
+func GetSequences(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetSequences()")
+
+	modelMutex.RLock()
+	defer modelMutex.RUnlock()
+
+	params := map[string]int{"minLen": sequenceMinLen, "maxLen": sequenceMaxLen, "minSupport": sequenceMinSupport, "limit": sequenceLimit}
+	for name, value := range params {
+		if str := c.Query(name); str != "" {
+			v, err := strconv.Atoi(str)
+			if err != nil || v < 1 {
+				c.JSON(http.StatusBadRequest, "Niepoprawny parametr "+name)
+				return
+			}
+			value = v
+		}
+		params[name] = value
+	}
+	if params["minLen"] > params["maxLen"] || params["maxLen"] > sequenceMaxLenLimit {
+		c.JSON(http.StatusBadRequest, "Niepoprawna długość sekwencji (1.."+strconv.Itoa(sequenceMaxLenLimit)+")")
+		return
+	}
+	rare := sequenceRareShare
+	if str := c.Query("rare"); str != "" {
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil || v <= 0 || v >= 1 {
+			c.JSON(http.StatusBadRequest, "Niepoprawny parametr rare (0..1)")
+			return
+		}
+		rare = v
+	}
+
+	m := model
+	report := MineSequences(m.StateVisits(machineTimeline), params["minLen"], params["maxLen"], params["minSupport"], rare)
+	if len(report.Patterns) > params["limit"] {
+		report.Patterns = report.Patterns[:params["limit"]]
+	}
+	if len(report.Variants) > params["limit"] {
+		report.Variants = report.Variants[:params["limit"]]
+	}
+	c.JSON(http.StatusOK, report)
+}
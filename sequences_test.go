@@ -0,0 +1,54 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestMineSequences - Zamknięte częste łańcuchy kroków i rzadkie warianty
+// ================================================================================================
+func TestMineSequences(t *testing.T) {
+	// cztery odcinki: 3 x 0-1-2 i raz 0-1-3, kroki trwają 1 s, 2 s i 3 s
+	var segments [][]StateVisit
+	for k, last := range []int{2, 2, 2, 3} {
+		base := int64(k) * 10e9
+		segments = append(segments, []StateVisit{
+			{State: 0, Start: base, End: base + 1e9, Images: 1},
+			{State: 1, Start: base + 1e9, End: base + 3e9, Images: 1},
+			{State: last, Start: base + 3e9, End: base + 6e9, Images: 1},
+		})
+	}
+
+	report := MineSequences(segments, 2, 3, 3, 0.3)
+	if report.Visits != 12 {
+		t.Errorf("Visits = %d, want 12", report.Visits)
+	}
+	// 1-2 i samo 0 nie są zamknięte - zawiera je 0-1-2 z tym samym wsparciem
+	patterns := []StatePattern{
+		{Steps: []int{0, 1}, Support: 4, Duration: 3000, DurationMin: 3000, DurationMax: 3000, Last: 30e9},
+		{Steps: []int{0, 1, 2}, Support: 3, Duration: 6000, DurationMin: 6000, DurationMax: 6000, Last: 20e9},
+	}
+	if !reflect.DeepEqual(report.Patterns, patterns) {
+		t.Errorf("Patterns = %+v, want %+v", report.Patterns, patterns)
+	}
+	// 0-1-3 pominięty - to samo odstępstwo co 1-3 w dłuższym kontekście
+	if len(report.Variants) != 1 {
+		t.Fatalf("Variants = %+v, want only 1-3", report.Variants)
+	}
+	v := report.Variants[0]
+	if !reflect.DeepEqual(v.Steps, []int{1, 3}) || v.Support != 1 || v.Share != 0.25 ||
+		!reflect.DeepEqual(v.Common, []int{1, 2}) || !reflect.DeepEqual(v.Times, []int64{31e9}) {
+		t.Errorf("variant %+v", v)
+	}
+
+	// udział 0.25 powyżej progu rzadkości - brak wariantów, wzorce bez zmian
+	report = MineSequences(segments, 2, 3, 3, 0.2)
+	if len(report.Variants) != 0 || len(report.Patterns) != 2 {
+		t.Errorf("rare 0.2: %d patterns, variants %+v", len(report.Patterns), report.Variants)
+	}
+	// żaden łańcuch nie ma wsparcia 5
+	report = MineSequences(segments, 2, 3, 5, 0.3)
+	if len(report.Patterns) != 0 || len(report.Variants) != 0 {
+		t.Errorf("support 5: %+v", report)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"strconv"
+)
+
+// analogMinValues - Ilość różnych wartości bajtu powyżej której traktujemy go jako sygnał ciągły
+const analogMinValues = 16
+
+// AnalogSignal - Sygnał ciągły (zmienna analogowa lub bajt/słowo bez definicji)
+// ========================================================
+type AnalogSignal struct {
+	Name  string
+	value func(image [imageSize]byte) (float64, bool)
+}
+
+// AnalogRange - Zakres wartości sygnału ciągłego w danym stanie
+// ========================================================
+type AnalogRange struct {
+	Signal string  `json:"Signal"`
+	Min    float64 `json:"Min"`
+	Max    float64 `json:"Max"`
+	Mean   float64 `json:"Mean"`
+	Count  int     `json:"Count"`
+
+	sum float64
+}
+
+// analogTypes - Typy zmiennych zawsze traktowane jako ciągłe
+// ========================================================
+var analogTypes = map[string]bool{
+	"INT":    true,
+	"DINT":   true,
+	"REAL":   true,
+	"S5TIME": true,
+	"DT":     true,
+	"DTL":    true,
+}
+
+// DistinctValues - Ilość różnych wartości bajtu zarejestrowanych w valuesRange modelu
+// ================================================================================================
+func (m *Model) DistinctValues(index int) int {
+	cnt := 0
+	for cval := 0; cval < 256; cval++ {
+		if m.valuesRange[cval][index] > 0 {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// ClassifySignals - Podział bajtów obrazu na dyskretne i ciągłe
+//
+// 1) Bajty zmiennych analogowych (INT, DINT, REAL...) są zawsze ciągłe
+// 2) Bajt z ilością wartości powyżej analogMinValues jest ciągły
+// 3) Drugi bajt tego samego słowa też jest ciągły jeżeli się zmienia (starszy bajt licznika)
+// ================================================================================================
+func (m *Model) ClassifySignals() {
+	var analog [imageSize]bool
+
+	for _, t := range tags {
+		if analogTypes[t.Type] {
+			for i := 0; i < t.addr.Size; i++ {
+				analog[t.addr.Offset+i] = true
+			}
+		}
+	}
+
+	for i := 0; i < imageSize; i++ {
+		if m.DistinctValues(i) > analogMinValues {
+			analog[i] = true
+			if pair := i ^ 1; m.DistinctValues(pair) > 1 {
+				analog[pair] = true
+			}
+		}
+	}
+
+	m.analogBytes = analog
+	m.analogSignals = nil
+
+	// sygnały zdefiniowane jako zmienne
+	var tagged [imageSize]bool
+	for _, t := range tags {
+		if t.Type == "BOOL" || !(analogTypes[t.Type] || analog[t.addr.Offset]) {
+			continue
+		}
+		for i := 0; i < t.addr.Size; i++ {
+			tagged[t.addr.Offset+i] = true
+		}
+		m.analogSignals = append(m.analogSignals, AnalogSignal{Name: t.Name, value: t.Numeric})
+	}
+
+	// pozostałe bajty ciągłe - jako słowa (oba bajty ciągłe) lub bajty
+	for i := 0; i < imageSize; i++ {
+		if !analog[i] || tagged[i] {
+			continue
+		}
+		offset := i
+		if i%2 == 0 && i+1 < imageSize && analog[i+1] && !tagged[i+1] {
+			name := areaNames[offset/areaSize] + "W" + strconv.Itoa(offset%areaSize)
+			m.analogSignals = append(m.analogSignals, AnalogSignal{
+				Name: name,
+				value: func(image [imageSize]byte) (float64, bool) {
+					return float64(binary.BigEndian.Uint16(image[offset:])), true
+				},
+			})
+			i++
+			continue
+		}
+		m.analogSignals = append(m.analogSignals, AnalogSignal{
+			Name: FormatAddress(offset, -1),
+			value: func(image [imageSize]byte) (float64, bool) {
+				return float64(image[offset]), true
+			},
+		})
+	}
+
+	log.Println(len(m.analogSignals), "analog signals found")
+}
+
+// SameSignals - Te same sygnały ciągłe w tej samej kolejności (zakresy w stanach są po indeksie)
+// ================================================================================================
+func SameSignals(a []AnalogSignal, b []AnalogSignal) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// DigitalMask - Maska bajtów dyskretnych (ciągłe wyzerowane)
+// ================================================================================================
+func (m *Model) DigitalMask() [imageSize]byte {
+	var mask [imageSize]byte
+	for i := 0; i < imageSize; i++ {
+		if !m.analogBytes[i] {
+			mask[i] = 0xff
+		}
+	}
+	return mask
+}
+
+// FindState - Numer stanu w tablicy machineStates lub -1
+// ================================================================================================
+func (m *Model) FindState(image [imageSize]byte) int {
+	for k, state := range m.machineStates {
+		if ImageCompare(state, image) == 0 {
+			return k
+		}
+	}
+	return -1
+}
+
+// AnalyzeAnalog - update zakresów sygnałów ciągłych w stanach
+// ================================================================================================
+func (m *Model) AnalyzeAnalog(timeline []MachineImage) {
+
+	for len(m.statesAnalog) < len(m.machineStates) {
+		ranges := make([]AnalogRange, len(m.analogSignals))
+		for i, signal := range m.analogSignals {
+			ranges[i].Signal = signal.Name
+		}
+		m.statesAnalog = append(m.statesAnalog, ranges)
+	}
+
+	length := len(timeline)
+	for i := m.analogID; i < length; i++ {
+		k := m.FindState(MaskedImage(timeline[i].IOImage, m.maskImage))
+		if k < 0 {
+			continue
+		}
+		for j, signal := range m.analogSignals {
+			value, ok := signal.value(timeline[i].IOImage)
+			if !ok {
+				continue
+			}
+			r := &m.statesAnalog[k][j]
+			if r.Count == 0 || value < r.Min {
+				r.Min = value
+			}
+			if r.Count == 0 || value > r.Max {
+				r.Max = value
+			}
+			r.Count++
+			r.sum += value
+			r.Mean = r.sum / float64(r.Count)
+		}
+	}
+	m.analogID = length
+}
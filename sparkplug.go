@@ -0,0 +1,115 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Typy danych Sparkplug B (org.eclipse.tahu.protobuf.DataType)
+const (
+	spInt32   = 3
+	spInt64   = 4
+	spUInt64  = 8
+	spBoolean = 11
+	spString  = 12
+)
+
+// spMetric - Metryka Sparkplug B
+// ========================================================
+type spMetric struct {
+	Name  string
+	Type  uint32
+	Value interface{}
+}
+
+// SparkplugPayload - Kodowanie wiadomości Sparkplug B (protobuf)
+// Payload: timestamp = 1, metrics = 2, seq = 3
+// Metric: name = 1, timestamp = 3, datatype = 4, is_null = 7, int_value = 10, long_value = 11,
+// boolean_value = 14, string_value = 15
+// ================================================================================================
+func SparkplugPayload(timestamp uint64, seq uint64, metrics []spMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	for _, metric := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sparkplugMetric(timestamp, metric))
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, seq)
+	return b
+}
+
+// sparkplugMetric - Kodowanie metryki Sparkplug B
+// ================================================================================================
+func sparkplugMetric(timestamp uint64, metric spMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, metric.Name)
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(metric.Type))
+
+	switch v := metric.Value.(type) {
+	case nil:
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	case int:
+		// int32 zapisywany jako uint32 (dopełnienie do dwóch)
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(int32(v))))
+	case int64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+// SparkplugMetrics - Metryki urządzenia (PLC) dla zdarzenia
+// ================================================================================================
+func SparkplugMetrics(e Event) []spMetric {
+	switch d := e.Data.(type) {
+	case StateEvent:
+		return []spMetric{{"State", spInt32, d.State}}
+	case TransitionEvent:
+		return []spMetric{
+			{"Transition/Src", spInt32, d.Src},
+			{"Transition/Dst", spInt32, d.Dst},
+			{"Transition/Time", spInt64, d.Time},
+		}
+	case CycleEvent:
+		return []spMetric{{"Cycle/Time", spInt64, d.Time}}
+	case CPUStateChange:
+		return []spMetric{{"CPU/State", spString, d.State}}
+	case AnomalyEvent:
+		return []spMetric{
+			{"Anomaly/Reason", spString, d.Reason},
+			{"Anomaly/Src", spInt32, d.Src},
+			{"Anomaly/Dst", spInt32, d.Dst},
+			{"Anomaly/Time", spInt64, d.Time},
+		}
+	}
+	return nil
+}
+
+// SparkplugBirth - Wszystkie metryki urządzenia (DBIRTH), wartości jeszcze nieznane
+// ================================================================================================
+func SparkplugBirth() []spMetric {
+	var metrics []spMetric
+	for _, e := range []Event{{Data: StateEvent{}}, {Data: TransitionEvent{}}, {Data: CycleEvent{}}, {Data: AnomalyEvent{}}, {Data: CPUStateChange{}}} {
+		for _, metric := range SparkplugMetrics(e) {
+			metric.Value = nil
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics
+}
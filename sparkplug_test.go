@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// spDecoded - Odczytana wiadomość Sparkplug B
+// ========================================================
+type spDecoded struct {
+	Timestamp uint64
+	Seq       uint64
+	Metrics   []spMetric
+}
+
+// decodeSparkplug - Dekodowanie wiadomości Sparkplug B (pola jak w SparkplugPayload)
+// ================================================================================================
+func decodeSparkplug(t *testing.T, b []byte) spDecoded {
+	t.Helper()
+	var p spDecoded
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var metric []byte
+			metric, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				p.Metrics = append(p.Metrics, decodeMetric(t, metric, p.Timestamp))
+			}
+		case num == 3 && typ == protowire.VarintType:
+			p.Seq, n = protowire.ConsumeVarint(b)
+		default:
+			t.Fatalf("unexpected payload field %d", num)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return p
+}
+
+// decodeMetric - Dekodowanie metryki (wartość w typie Go jak przy kodowaniu)
+// ================================================================================================
+func decodeMetric(t *testing.T, b []byte, timestamp uint64) spMetric {
+	t.Helper()
+	var metric spMetric
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ == protowire.BytesType {
+			var s string
+			s, n = protowire.ConsumeString(b)
+			switch num {
+			case 1:
+				metric.Name = s
+			case 15:
+				metric.Value = s
+			}
+		} else {
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			switch num {
+			case 3:
+				if v != timestamp {
+					t.Errorf("metric timestamp %d, want %d", v, timestamp)
+				}
+			case 4:
+				metric.Type = uint32(v)
+			case 7:
+				metric.Value = nil
+			case 10:
+				metric.Value = int(int32(uint32(v)))
+			case 11:
+				if metric.Type == spUInt64 {
+					metric.Value = v
+				} else {
+					metric.Value = int64(v)
+				}
+			case 14:
+				metric.Value = protowire.DecodeBool(v)
+			}
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return metric
+}
+
+// TestSparkplugPayload - Kodowanie i odczyt wiadomości Sparkplug B
+// ================================================================================================
+func TestSparkplugPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		seq     uint64
+		metrics []spMetric
+	}{
+		{"state", 0, []spMetric{{"State", spInt32, 3}}},
+		{"negative state", 1, []spMetric{{"State", spInt32, -1}}},
+		{"transition", 2, SparkplugMetrics(Event{Data: TransitionEvent{Src: 1, Dst: 2, Time: 1500}})},
+		{"anomaly", 3, SparkplugMetrics(Event{Data: AnomalyEvent{Reason: "unknown", Src: 4, Dst: -1, Time: -20}})},
+		{"cpu", 255, SparkplugMetrics(Event{Data: CPUStateChange{State: "STOP"}})},
+		{"node birth", 0, []spMetric{{"bdSeq", spUInt64, uint64(1 << 40)}, {"Node Control/Rebirth", spBoolean, false}}},
+		{"device birth", 7, SparkplugBirth()},
+	}
+	for _, tt := range tests {
+		timestamp := uint64(1700000000123)
+		p := decodeSparkplug(t, SparkplugPayload(timestamp, tt.seq, tt.metrics))
+		if p.Timestamp != timestamp || p.Seq != tt.seq {
+			t.Errorf("%s: timestamp %d seq %d", tt.name, p.Timestamp, p.Seq)
+		}
+		if !reflect.DeepEqual(p.Metrics, tt.metrics) {
+			t.Errorf("%s: metrics %v, want %v", tt.name, p.Metrics, tt.metrics)
+		}
+	}
+}
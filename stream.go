@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamConfig - Parametry strumienia SSE dla sesji
+// Push: "interval" (obraz co DataInterval) lub "change" (obraz zaraz po zmianie)
+// PollInterval - okres odczytu z PLC (stała częstotliwość, czas odczytu jest odliczany)
+// ========================================================
+type StreamConfig struct {
+	DataInterval   time.Duration `yaml:"data_interval" json:"DataInterval"`
+	StatsInterval  time.Duration `yaml:"stats_interval" json:"StatsInterval"`
+	CyclesInterval time.Duration `yaml:"cycles_interval" json:"CyclesInterval"`
+	PollInterval   time.Duration `yaml:"poll_interval" json:"PollInterval"`
+	Push           string        `yaml:"push" json:"Push"`
+	Coalesce       time.Duration `yaml:"coalesce" json:"Coalesce"`
+}
+
+// DefaultStreamConfig - Domyślne parametry strumienia
+// ================================================================================================
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		DataInterval:   500 * time.Millisecond,
+		StatsInterval:  5000 * time.Millisecond,
+		CyclesInterval: 5000 * time.Millisecond,
+		PollInterval:   10 * time.Millisecond,
+		Push:           "interval",
+		Coalesce:       20 * time.Millisecond,
+	}
+}
+
+// msParam - Parametr czasu w milisekundach z zapytania
+// ================================================================================================
+func msParam(c *gin.Context, name string, def time.Duration, min int) (time.Duration, error) {
+	str := c.Query(name)
+	if str == "" {
+		return def, nil
+	}
+	ms, err := strconv.Atoi(str)
+	if err != nil || ms < min {
+		return def, errors.New("niepoprawny parametr " + name)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// ParseStreamConfig - Parametry strumienia z zapytania (domyślne z konfiguracji)
+// (data_ms, stats_ms, cycles_ms, poll_ms, push=interval|change, coalesce_ms)
+// ================================================================================================
+func ParseStreamConfig(c *gin.Context) (StreamConfig, error) {
+	cfg := config.Stream
+	var err error
+	params := []struct {
+		name  string
+		value *time.Duration
+		min   int
+	}{
+		{"data_ms", &cfg.DataInterval, 1},
+		{"stats_ms", &cfg.StatsInterval, 100},
+		{"cycles_ms", &cfg.CyclesInterval, 100},
+		{"poll_ms", &cfg.PollInterval, 0},
+		{"coalesce_ms", &cfg.Coalesce, 0},
+	}
+	for _, p := range params {
+		if *p.value, err = msParam(c, p.name, *p.value, p.min); err != nil {
+			return cfg, err
+		}
+	}
+	if push := c.Query("push"); push != "" {
+		if push != "interval" && push != "change" {
+			return cfg, errors.New("niepoprawny parametr push (interval, change)")
+		}
+		cfg.Push = push
+	}
+	return cfg, nil
+}
+
+// dataPusher - Decyzja o wysłaniu obrazu w strumieniu
+// ========================================================
+type dataPusher struct {
+	cfg     StreamConfig
+	last    [imageSize]byte
+	sent    int64
+	pending bool
+}
+
+// Due - Czy wysłać obraz odczytany w chwili now
+// W trybie "change" pierwsza zmiana po oknie Coalesce idzie od razu, kolejne zmiany w oknie są
+// łączone i po oknie wysyłany jest stan aktualny - impuls krótszy niż Coalesce, który zaczyna się
+// i kończy w oknie, nie zostanie wysłany (coalesce: 0 - każda zmiana); DataInterval działa
+// wtedy jako podtrzymanie
+// ================================================================================================
+func (p *dataPusher) Due(buf [imageSize]byte, now int64) bool {
+	elapsed := time.Duration(now - p.sent)
+	due := elapsed > p.cfg.DataInterval
+	if p.cfg.Push == "change" {
+		if buf != p.last || p.sent == 0 {
+			p.pending = true
+		}
+		due = due || p.pending && elapsed >= p.cfg.Coalesce
+	}
+	if due {
+		p.last = buf
+		p.sent = now
+		p.pending = false
+	}
+	return due
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robinson/gos7"
+)
+
+const areaSize = 128
+
+// areaNames - Obszary obrazu w kolejności zapisu w IOImage (MB, EB, AB)
+// ========================================================
+var areaNames = [3]string{"M", "E", "A"}
+
+// Address - Adres w obrazie maszyny
+// ========================================================
+type Address struct {
+	Offset int // indeks bajtu w IOImage
+	Bit    int // numer bitu lub -1 dla adresu bajtowego
+	Size   int // rozmiar w bajtach wynikający z adresu (B/W/D)
+}
+
+// Tag - Definicja zmiennej typowanej w obrazie
+// ========================================================
+type Tag struct {
+	Name    string `yaml:"name" json:"Name"`
+	Address string `yaml:"address" json:"Address"`
+	Type    string `yaml:"type" json:"Type"`
+	Length  int    `yaml:"length,omitempty" json:"Length,omitempty"`
+
+	addr Address
+}
+
+// TagValue - Wartość zmiennej w chwili czasu
+// ========================================================
+type TagValue struct {
+	Timestamp int64       `json:"Timestamp"`
+	Value     interface{} `json:"Value"`
+}
+
+// tags - Zdefiniowane zmienne
+// ========================================================
+var tags []Tag
+
+// tagSizes - Rozmiary typów w bajtach (STRING liczony osobno)
+// ========================================================
+var tagSizes = map[string]int{
+	"BOOL":   0,
+	"BYTE":   1,
+	"CHAR":   1,
+	"WORD":   2,
+	"INT":    2,
+	"S5TIME": 2,
+	"DWORD":  4,
+	"DINT":   4,
+	"REAL":   4,
+	"DT":     8,
+	"DTL":    12,
+}
+
+// ParseAddress - Parsowanie adresu S7 (M10.3, MB10, MW10, MD10, E1.0, IW2, A4.0, QB4)
+// ================================================================================================
+func ParseAddress(str string) (Address, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	if s == "" {
+		return Address{}, errors.New("pusty adres")
+	}
+
+	var base int
+	switch s[0] {
+	case 'M':
+		base = areaSize * 0
+	case 'E', 'I':
+		base = areaSize * 1
+	case 'A', 'Q':
+		base = areaSize * 2
+	default:
+		return Address{}, errors.New("nieznany obszar w adresie " + str)
+	}
+	s = s[1:]
+
+	size := 1
+	bitAddress := true
+	if len(s) > 0 {
+		switch s[0] {
+		case 'X':
+			s = s[1:]
+		case 'B':
+			bitAddress = false
+			s = s[1:]
+		case 'W':
+			bitAddress = false
+			size = 2
+			s = s[1:]
+		case 'D':
+			bitAddress = false
+			size = 4
+			s = s[1:]
+		}
+	}
+
+	bit := -1
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		if !bitAddress {
+			return Address{}, errors.New("adres bajtowy z numerem bitu " + str)
+		}
+		b, err := strconv.Atoi(s[dot+1:])
+		if err != nil || b < 0 || b > 7 {
+			return Address{}, errors.New("niepoprawny numer bitu w adresie " + str)
+		}
+		bit = b
+		s = s[:dot]
+	} else if bitAddress {
+		return Address{}, errors.New("brak numeru bitu w adresie " + str)
+	}
+
+	offset, err := strconv.Atoi(s)
+	if err != nil || offset < 0 || offset+size > areaSize {
+		return Address{}, errors.New("niepoprawny numer bajtu w adresie " + str)
+	}
+
+	return Address{Offset: base + offset, Bit: bit, Size: size}, nil
+}
+
+// FormatAddress - Adres bitu/bajtu obrazu w notacji S7 (M10.3, EB1)
+// ================================================================================================
+func FormatAddress(offset int, bit int) string {
+	area := areaNames[offset/areaSize]
+	if bit < 0 {
+		return area + "B" + strconv.Itoa(offset%areaSize)
+	}
+	return area + strconv.Itoa(offset%areaSize) + "." + strconv.Itoa(bit)
+}
+
+// AddressKey - Znormalizowany adres (E zamiast I, A zamiast Q) do porównywania adresów
+// ================================================================================================
+func AddressKey(addr Address) string {
+	if addr.Bit >= 0 {
+		return FormatAddress(addr.Offset, addr.Bit)
+	}
+	size := map[int]string{2: "W", 4: "D"}[addr.Size]
+	if size == "" {
+		return FormatAddress(addr.Offset, -1)
+	}
+	return areaNames[addr.Offset/areaSize] + size + strconv.Itoa(addr.Offset%areaSize)
+}
+
+// Validate - Sprawdzenie definicji zmiennej i wyliczenie położenia w obrazie
+// ================================================================================================
+func (t *Tag) Validate() error {
+	if t.Name == "" {
+		return errors.New("brak nazwy zmiennej")
+	}
+	t.Type = strings.ToUpper(t.Type)
+	if t.Type == "DATE_AND_TIME" {
+		t.Type = "DT"
+	}
+
+	addr, err := ParseAddress(t.Address)
+	if err != nil {
+		return err
+	}
+
+	size, ok := tagSizes[t.Type]
+	switch {
+	case t.Type == "STRING":
+		if t.Length <= 0 || t.Length > 254 {
+			return errors.New("niepoprawna długość STRING dla " + t.Name)
+		}
+		size = t.Length + 2
+	case !ok:
+		return errors.New("nieznany typ " + t.Type + " dla " + t.Name)
+	}
+
+	if t.Type == "BOOL" {
+		if addr.Bit < 0 {
+			return errors.New("typ BOOL wymaga adresu bitowego dla " + t.Name)
+		}
+	} else {
+		if addr.Bit >= 0 {
+			return errors.New("typ " + t.Type + " wymaga adresu bajtowego dla " + t.Name)
+		}
+		// zmienna nie może wychodzić poza obszar (MB/EB/AB)
+		if addr.Offset%areaSize+size > areaSize {
+			return errors.New("zmienna " + t.Name + " wychodzi poza obszar")
+		}
+		addr.Size = size
+	}
+
+	t.addr = addr
+	return nil
+}
+
+// Decode - Odczyt wartości zmiennej z obrazu (kodowanie big-endian S7)
+// ================================================================================================
+func (t Tag) Decode(image [imageSize]byte) interface{} {
+	var s7 gos7.Helper
+	buf := image[:]
+	pos := t.addr.Offset
+
+	switch t.Type {
+	case "BOOL":
+		return image[pos]&(1<<uint(t.addr.Bit)) != 0
+	case "BYTE":
+		return image[pos]
+	case "CHAR":
+		return string(rune(image[pos]))
+	case "WORD":
+		return binary.BigEndian.Uint16(buf[pos:])
+	case "INT":
+		return int16(binary.BigEndian.Uint16(buf[pos:]))
+	case "DWORD":
+		return binary.BigEndian.Uint32(buf[pos:])
+	case "DINT":
+		return int32(binary.BigEndian.Uint32(buf[pos:]))
+	case "REAL":
+		value := float64(math.Float32frombits(binary.BigEndian.Uint32(buf[pos:])))
+		// NaN i Inf nie dają się zapisać w JSON
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil
+		}
+		return value
+	case "S5TIME":
+		return s7.GetS5TimeAt(buf, pos).Milliseconds()
+	case "DT":
+		return jsonTime(s7.GetDateTimeAt(buf, pos))
+	case "DTL":
+		return jsonTime(s7.GetDTLAt(buf, pos))
+	case "STRING":
+		length := int(image[pos+1])
+		if length > t.Length {
+			length = t.Length
+		}
+		return string(buf[pos+2 : pos+2+length])
+	}
+	return nil
+}
+
+// jsonTime - Czas daty lub nil, gdy rok poza 0..9999 (np. niezapisany obszar - nie daje się zapisać w JSON)
+// ================================================================================================
+func jsonTime(t time.Time) interface{} {
+	if t.Year() < 0 || t.Year() > 9999 {
+		return nil
+	}
+	return t
+}
+
+// Numeric - Wartość liczbowa zmiennej (dla sygnałów analogowych)
+// ================================================================================================
+func (t Tag) Numeric(image [imageSize]byte) (float64, bool) {
+	switch v := t.Decode(image).(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case byte:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// TagValues - Wartości wszystkich zmiennych dla obrazu
+// ================================================================================================
+func TagValues(image [imageSize]byte) map[string]interface{} {
+	values := make(map[string]interface{}, len(tags))
+	for _, t := range tags {
+		values[t.Name] = t.Decode(image)
+	}
+	return values
+}
+
+// FindTag - Szukanie zmiennej po nazwie
+// ================================================================================================
+func FindTag(name string) (Tag, bool) {
+	for _, t := range tags {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Tag{}, false
+}
+
+// SetTag - Dodanie lub zastąpienie definicji zmiennej
+// ================================================================================================
+func SetTag(t Tag) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	for i := range tags {
+		if tags[i].Name == t.Name {
+			tags[i] = t
+			return nil
+		}
+	}
+	tags = append(tags, t)
+	return nil
+}
+
+// ParseTimeParam - Czas z parametru zapytania (unix ns lub RFC3339)
+// ================================================================================================
+func ParseTimeParam(str string, def int64) (int64, error) {
+	if str == "" {
+		return def, nil
+	}
+	if ns, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return ns, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return 0, errors.New("niepoprawny czas " + str)
+	}
+	return t.UnixNano(), nil
+}
+
+// TagHistory - Historia wartości zmiennej z timeline (tylko zmiany)
+// ================================================================================================
+func TagHistory(t Tag, from int64, to int64) []TagValue {
+	var history []TagValue
+	var last interface{}
+	for _, image := range machineTimeline {
+		if image.Timestamp < from || image.Timestamp > to {
+			continue
+		}
+		value := t.Decode(image.IOImage)
+		if len(history) > 0 && value == last {
+			continue
+		}
+		history = append(history, TagValue{Timestamp: image.Timestamp, Value: value})
+		last = value
+	}
+	return history
+}
+
+// GetTags - Lista zmiennych z aktualnymi wartościami
+// ================================================================================================
+func GetTags(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetTags()")
+
+	var values map[string]interface{}
+	if n := len(machineTimeline); n > 0 {
+		values = TagValues(machineTimeline[n-1].IOImage)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tags":   tags,
+		"values": values,
+	})
+}
+
+// PostTag - Dodanie definicji zmiennej
+// ================================================================================================
+func PostTag(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("PostTag()")
+
+	var t Tag
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := SetTag(t); err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// DeleteTag - Usunięcie definicji zmiennej
+// ================================================================================================
+func DeleteTag(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("DeleteTag()")
+
+	name := c.Param("name")
+	for i := range tags {
+		if tags[i].Name == name {
+			tags = append(tags[:i], tags[i+1:]...)
+			c.JSON(http.StatusOK, name)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, "Nie znaleziono zmiennej "+name)
+}
+
+// GetTagHistory - Historia wartości zmiennej (JSON lub CSV)
+// ================================================================================================
+func GetTagHistory(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetTagHistory()")
+
+	t, ok := FindTag(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, "Nie znaleziono zmiennej "+c.Param("name"))
+		return
+	}
+	from, err := ParseTimeParam(c.Query("from"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseTimeParam(c.Query("to"), math.MaxInt64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	history := TagHistory(t, from, to)
+
+	if c.Query("format") != "csv" {
+		c.JSON(http.StatusOK, history)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename="+t.Name+".csv")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"Timestamp", t.Name})
+	for _, v := range history {
+		w.Write([]string{strconv.FormatInt(v.Timestamp, 10), FormatValue(v.Value)})
+	}
+	w.Flush()
+}
+
+// FormatValue - Wartość zmiennej jako tekst (CSV)
+// ================================================================================================
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
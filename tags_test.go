@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseAddress - Adresy S7 w notacji niemieckiej i angielskiej
+// ================================================================================================
+func TestParseAddress(t *testing.T) {
+	valid := map[string]Address{
+		"M10.3":  {Offset: 10, Bit: 3, Size: 1},
+		"mx10.3": {Offset: 10, Bit: 3, Size: 1},
+		"MB0":    {Offset: 0, Bit: -1, Size: 1},
+		"MW126":  {Offset: 126, Bit: -1, Size: 2},
+		"MD124":  {Offset: 124, Bit: -1, Size: 4},
+		"E1.0":   {Offset: 129, Bit: 0, Size: 1},
+		" I1.0 ": {Offset: 129, Bit: 0, Size: 1},
+		"IW2":    {Offset: 130, Bit: -1, Size: 2},
+		"A4.7":   {Offset: 260, Bit: 7, Size: 1},
+		"QB127":  {Offset: 383, Bit: -1, Size: 1},
+	}
+	for str, want := range valid {
+		if got, err := ParseAddress(str); err != nil || got != want {
+			t.Errorf("ParseAddress(%q) = %+v, %v, want %+v", str, got, err, want)
+		}
+	}
+	// bloki danych, brak bitu, bit > 7, słowo poza obszarem
+	for _, str := range []string{"", "DB1.DBX0.0", "M10", "M10.8", "MB10.1", "MW127", "MD125", "M128.0", "M-1.0"} {
+		if _, err := ParseAddress(str); err == nil {
+			t.Errorf("ParseAddress(%q) accepted", str)
+		}
+	}
+}
+
+// TestDecode - Wartości zmiennych typowanych z obrazu (big-endian S7)
+// ================================================================================================
+func TestDecode(t *testing.T) {
+	var image [imageSize]byte
+	copy(image[0:], []byte{0x05})                   // MB0 / M0.0, M0.2
+	copy(image[2:], []byte{0xFF, 0x38})             // MW2 = -200
+	copy(image[4:], []byte{0x12, 0x34, 0x56, 0x78}) // MD4
+	copy(image[8:], []byte{0x40, 0x49, 0x0F, 0xDB}) // MD8 = 3.1415927
+	copy(image[12:], []byte{0x7F, 0xC0, 0x00, 0x00})
+	copy(image[16:], []byte{0x21, 0x27})          // S5TIME 127 * 1 s
+	copy(image[18:], []byte{5, 3, 'a', 'b', 'c'}) // STRING[5] "abc"
+	copy(image[24:], []byte{0x24, 0x03, 0x15, 0x10, 0x30, 0x45, 0x12, 0x34})
+	copy(image[32:], []byte{0x07, 0xE8, 3, 15, 5, 10, 30, 45, 0, 0, 0, 0})
+	image[128] = 'Z' // EB0
+
+	tests := []struct {
+		tag  Tag
+		want interface{}
+	}{
+		{Tag{Name: "b0", Address: "M0.0", Type: "BOOL"}, true},
+		{Tag{Name: "b1", Address: "M0.1", Type: "BOOL"}, false},
+		{Tag{Name: "byte", Address: "MB0", Type: "BYTE"}, byte(5)},
+		{Tag{Name: "char", Address: "EB0", Type: "CHAR"}, "Z"},
+		{Tag{Name: "word", Address: "MW2", Type: "WORD"}, uint16(0xFF38)},
+		{Tag{Name: "int", Address: "MW2", Type: "INT"}, int16(-200)},
+		{Tag{Name: "dword", Address: "MD4", Type: "DWORD"}, uint32(0x12345678)},
+		{Tag{Name: "dint", Address: "MD4", Type: "DINT"}, int32(0x12345678)},
+		{Tag{Name: "real", Address: "MD8", Type: "REAL"}, float64(float32(3.1415927))},
+		{Tag{Name: "nan", Address: "MD12", Type: "REAL"}, nil},
+		{Tag{Name: "s5time", Address: "MW16", Type: "S5TIME"}, int64(127000)},
+		{Tag{Name: "string", Address: "MB18", Type: "STRING", Length: 5}, "abc"},
+		{Tag{Name: "dt", Address: "MB24", Type: "DATE_AND_TIME"}, time.Date(2024, 3, 15, 10, 30, 45, 123000000, time.UTC)},
+		{Tag{Name: "dtl", Address: "MB32", Type: "DTL"}, time.Date(2024, 3, 15, 10, 30, 45, 0, time.UTC)},
+		{Tag{Name: "empty dtl", Address: "MB60", Type: "DTL"}, nil},
+	}
+	for _, tt := range tests {
+		if err := tt.tag.Validate(); err != nil {
+			t.Errorf("%s: %v", tt.tag.Name, err)
+			continue
+		}
+		got := tt.tag.Decode(image)
+		if want, ok := tt.want.(time.Time); ok {
+			if got, ok := got.(time.Time); !ok || !got.Equal(want) {
+				t.Errorf("%s: Decode = %v, want %v", tt.tag.Name, got, want)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: Decode = %v (%T), want %v (%T)", tt.tag.Name, got, got, tt.want, tt.want)
+		}
+	}
+}
+
+// TestTagValidate - Niepoprawne definicje zmiennych
+// ================================================================================================
+func TestTagValidate(t *testing.T) {
+	tests := []Tag{
+		{Address: "MW2", Type: "INT"},
+		{Name: "x", Address: "MW2", Type: "LREAL"},
+		{Name: "x", Address: "MB2", Type: "BOOL"},
+		{Name: "x", Address: "M2.0", Type: "INT"},
+		{Name: "x", Address: "MD126", Type: "DINT"},
+		{Name: "x", Address: "MB120", Type: "DTL"},
+		{Name: "x", Address: "MB0", Type: "STRING"},
+		{Name: "x", Address: "MB0", Type: "STRING", Length: 255},
+	}
+	for _, tag := range tests {
+		if err := tag.Validate(); err == nil {
+			t.Errorf("Validate(%+v) accepted", tag)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Signal - Wybrany sygnał obrazu (bit, bajt/słowo/dwusłowo lub zmienna)
+// ========================================================
+type Signal struct {
+	Name string
+	addr Address
+	tag  *Tag
+}
+
+// TimelinePoint - Punkt przebiegu z wartościami wybranych sygnałów
+// ========================================================
+type TimelinePoint struct {
+	Timestamp int64         `json:"Timestamp"`
+	Values    []interface{} `json:"Values"`
+}
+
+// TimelineRange - Wynik zapytania o fragment timeline
+// ========================================================
+type TimelineRange struct {
+	From    int64            `json:"From"`
+	To      int64            `json:"To"`
+	Total   int              `json:"Total"`
+	Signals []string         `json:"Signals,omitempty"`
+	Images  []MachineImage   `json:"Images,omitempty"`
+	Points  []TimelinePoint  `json:"Points,omitempty"`
+	CPU     []CPUStateChange `json:"CPU,omitempty"` // zmiany RUN/STOP w przedziale (obrazów z STOP nie ma w timeline)
+}
+
+// ParseSignals - Lista sygnałów z tekstu (adresy S7 lub nazwy zmiennych rozdzielone przecinkiem)
+// ================================================================================================
+func ParseSignals(str string) ([]Signal, error) {
+	var signals []Signal
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if t, ok := FindTag(name); ok {
+			signals = append(signals, Signal{Name: name, addr: t.addr, tag: &t})
+			continue
+		}
+		addr, err := ParseAddress(name)
+		if err != nil {
+			return nil, errors.New("nieznany sygnał " + name)
+		}
+		signals = append(signals, Signal{Name: name, addr: addr})
+	}
+	return signals, nil
+}
+
+// Value - Wartość sygnału w obrazie
+// ================================================================================================
+func (s Signal) Value(image [imageSize]byte) interface{} {
+	if s.tag != nil {
+		return s.tag.Decode(image)
+	}
+	if s.addr.Bit >= 0 {
+		return image[s.addr.Offset]&(1<<uint(s.addr.Bit)) != 0
+	}
+	switch s.addr.Size {
+	case 2:
+		return binary.BigEndian.Uint16(image[s.addr.Offset:])
+	case 4:
+		return binary.BigEndian.Uint32(image[s.addr.Offset:])
+	}
+	return image[s.addr.Offset]
+}
+
+// Changed - Czy którykolwiek z sygnałów zmienił się między obrazami
+// ================================================================================================
+func Changed(signals []Signal, im1 [imageSize]byte, im2 [imageSize]byte) bool {
+	if len(signals) == 0 {
+		return ImageCompare(im1, im2) != 0
+	}
+	for _, s := range signals {
+		size := s.addr.Size
+		if s.addr.Bit >= 0 {
+			if (im1[s.addr.Offset]^im2[s.addr.Offset])&(1<<uint(s.addr.Bit)) != 0 {
+				return true
+			}
+			continue
+		}
+		for i := s.addr.Offset; i < s.addr.Offset+size; i++ {
+			if im1[i] != im2[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TimelineWindow - Obrazy z przedziału czasu (opcjonalnie tylko zmiany wybranych sygnałów)
+// ================================================================================================
+func TimelineWindow(timeline []MachineImage, from int64, to int64, signals []Signal, changes bool) []MachineImage {
+	var images []MachineImage
+	for i, image := range timeline {
+		if image.Timestamp < from || image.Timestamp > to {
+			continue
+		}
+		// pierwszy obraz w oknie zawsze - jest stanem początkowym przebiegu
+		if changes && len(images) > 0 && !Changed(signals, timeline[i-1].IOImage, image.IOImage) {
+			continue
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// signalMask - Maska bitów obrazu zajmowanych przez wybrane sygnały (bez sygnałów - cały obraz)
+// ================================================================================================
+func signalMask(signals []Signal) (mask [imageSize]byte) {
+	if len(signals) == 0 {
+		for i := range mask {
+			mask[i] = 0xFF
+		}
+		return mask
+	}
+	for _, s := range signals {
+		if s.addr.Bit >= 0 {
+			mask[s.addr.Offset] |= 1 << uint(s.addr.Bit)
+			continue
+		}
+		size := s.addr.Size
+		if size < 1 {
+			size = 1
+		}
+		for i := s.addr.Offset; i < s.addr.Offset+size && i < imageSize; i++ {
+			mask[i] = 0xFF
+		}
+	}
+	return mask
+}
+
+// Downsample - Ograniczenie ilości punktów
+// Okno dzielimy na max/2 przedziałów i z każdego bierzemy pierwszy i ostatni obraz,
+// dzięki temu przebieg zachowuje stan na granicach przedziałów. Jeśli bit wybranego sygnału
+// przyjął w przedziale wartość, której nie ma ani pierwszy, ani ostatni obraz (krótki impuls),
+// dokładany jest też pierwszy obraz z tą wartością - max jest więc celem, nie twardym limitem
+// ================================================================================================
+func Downsample(images []MachineImage, signals []Signal, max int) []MachineImage {
+	if max <= 0 || len(images) <= max {
+		return images
+	}
+	buckets := max / 2
+	if buckets == 0 {
+		return images[:max]
+	}
+	from := images[0].Timestamp
+	width := float64(images[len(images)-1].Timestamp-from+1) / float64(buckets)
+	mask := signalMask(signals)
+
+	var result []MachineImage
+	start := 0
+	for i := 1; i <= len(images); i++ {
+		if i < len(images) && int(math.Floor(float64(images[i].Timestamp-from)/width)) == int(math.Floor(float64(images[start].Timestamp-from)/width)) {
+			continue
+		}
+		result = appendBucket(result, images[start:i], &mask)
+		start = i
+	}
+	return result
+}
+
+// appendBucket - Pierwszy i ostatni obraz przedziału oraz obrazy z ukrytymi w nim impulsami
+// ================================================================================================
+func appendBucket(result []MachineImage, bucket []MachineImage, mask *[imageSize]byte) []MachineImage {
+	first, last := bucket[0].IOImage, bucket[len(bucket)-1].IOImage
+	// bity z wartością 1 (high) i 0 (low) już widoczne na pierwszym lub ostatnim obrazie
+	var high, low [imageSize]byte
+	for b := range high {
+		high[b] = first[b] | last[b]
+		low[b] = ^first[b] | ^last[b]
+	}
+	result = append(result, bucket[0])
+	for _, image := range bucket[1 : len(bucket)-1] {
+		hidden := false
+		for b := range high {
+			if (image.IOImage[b]&^high[b]|^image.IOImage[b]&^low[b])&mask[b] != 0 {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			continue
+		}
+		for b := range high {
+			high[b] |= image.IOImage[b]
+			low[b] |= ^image.IOImage[b]
+		}
+		result = append(result, image)
+	}
+	if len(bucket) > 1 {
+		result = append(result, bucket[len(bucket)-1])
+	}
+	return result
+}
+
+// GetTimeline - Fragment timeline (from, to, signals, changes, max)
+// ================================================================================================
+func GetTimeline(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetTimeline()")
+
+	from, err := ParseTimeParam(c.Query("from"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseTimeParam(c.Query("to"), math.MaxInt64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	signals, err := ParseSignals(c.Query("signals"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	max, err := strconv.Atoi(c.DefaultQuery("max", "0"))
+	if err != nil || max < 0 {
+		c.JSON(http.StatusBadRequest, "Niepoprawny parametr max")
+		return
+	}
+	changes := c.Query("changes") == "1" || c.Query("changes") == "true"
+
+	images := TimelineWindow(machineTimeline, from, to, signals, changes)
+	result := TimelineRange{From: from, To: to, Total: len(images), CPU: CPUChanges(from, to)}
+	images = Downsample(images, signals, max)
+
+	if len(signals) == 0 {
+		result.Images = images
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	for _, s := range signals {
+		result.Signals = append(result.Signals, s.Name)
+	}
+	result.Points = make([]TimelinePoint, 0, len(images))
+	for _, image := range images {
+		values := make([]interface{}, len(signals))
+		for i, s := range signals {
+			values[i] = s.Value(image.IOImage)
+		}
+		result.Points = append(result.Points, TimelinePoint{Timestamp: image.Timestamp, Values: values})
+	}
+	c.JSON(http.StatusOK, result)
+}
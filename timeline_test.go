@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// stamps - Znaczniki czasu obrazów
+// ================================================================================================
+func stamps(images []MachineImage) []int64 {
+	var result []int64
+	for _, image := range images {
+		result = append(result, image.Timestamp)
+	}
+	return result
+}
+
+// TestDownsample - Pierwszy i ostatni obraz z każdego przedziału czasu
+// ================================================================================================
+func TestDownsample(t *testing.T) {
+	var images []MachineImage
+	for ts := int64(0); ts < 100; ts++ {
+		images = append(images, MachineImage{Timestamp: ts})
+	}
+
+	if got := Downsample(images[:5], nil, 0); len(got) != 5 {
+		t.Errorf("max 0: %d images, want 5", len(got))
+	}
+	if got := Downsample(images[:5], nil, 5); len(got) != 5 {
+		t.Errorf("max 5: %d images, want 5", len(got))
+	}
+	if got := stamps(Downsample(images, nil, 1)); !reflect.DeepEqual(got, []int64{0}) {
+		t.Errorf("max 1: %v", got)
+	}
+	want := []int64{0, 19, 20, 39, 40, 59, 60, 79, 80, 99}
+	if got := stamps(Downsample(images, nil, 10)); !reflect.DeepEqual(got, want) {
+		t.Errorf("max 10: %v, want %v", got, want)
+	}
+
+	// puste przedziały są pomijane, przedział z jednym obrazem daje jeden punkt
+	sparse := []MachineImage{{Timestamp: 0}, {Timestamp: 1}, {Timestamp: 2}, {Timestamp: 50}, {Timestamp: 99}}
+	if got := stamps(Downsample(sparse, nil, 4)); !reflect.DeepEqual(got, []int64{0, 2, 50, 99}) {
+		t.Errorf("sparse: %v", got)
+	}
+}
+
+// TestDownsamplePulse - Krótki impuls wewnątrz przedziału nie może zniknąć
+// ================================================================================================
+func TestDownsamplePulse(t *testing.T) {
+	var images []MachineImage
+	for ts := int64(0); ts < 100; ts++ {
+		images = append(images, MachineImage{Timestamp: ts})
+	}
+	images[5].IOImage[0] = 0x01 // M0.0 tylko w jednym obrazie
+	images[6].IOImage[1] = 0x01 // M1.0 - sygnał niewybrany
+	for ts := 30; ts < 35; ts++ {
+		images[ts].IOImage[0] = 0x02 // M0.1 wysoki przez kilka obrazów
+	}
+
+	signals, err := ParseSignals("M0.0,M0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{0, 5, 19, 20, 30, 39, 40, 59, 60, 79, 80, 99}
+	if got := stamps(Downsample(images, signals, 10)); !reflect.DeepEqual(got, want) {
+		t.Errorf("signals: %v, want %v", got, want)
+	}
+	// bez wybranych sygnałów liczy się każdy bit obrazu
+	want = []int64{0, 5, 6, 19, 20, 30, 39, 40, 59, 60, 79, 80, 99}
+	if got := stamps(Downsample(images, nil, 10)); !reflect.DeepEqual(got, want) {
+		t.Errorf("image: %v, want %v", got, want)
+	}
+}
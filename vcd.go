@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// vcdWire - Przewód w pliku VCD
+// ========================================================
+type vcdWire struct {
+	id     string
+	name   string
+	width  int // ilość bitów (0 = real)
+	signal Signal
+	last   string
+}
+
+// vcdID - Identyfikator przewodu VCD (znaki drukowalne ASCII 33..126)
+// ================================================================================================
+func vcdID(n int) string {
+	id := ""
+	for {
+		id += string(rune(33 + n%94))
+		n = n/94 - 1
+		if n < 0 {
+			return id
+		}
+	}
+}
+
+// vcdName - Nazwa przewodu bez spacji i kropek (kropka to separator hierarchii w GTKWave)
+// ================================================================================================
+func vcdName(name string) string {
+	return strings.NewReplacer(" ", "_", ".", "_").Replace(strings.TrimSpace(name))
+}
+
+// ParseNames - Nazwy symboliczne sygnałów z tekstu "A4.1:Cylinder_Out,E2.3:Part_Present"
+// Zmienne typu BOOL dają nazwy dla swoich bitów automatycznie
+// ================================================================================================
+func ParseNames(str string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, t := range tags {
+		if t.Type == "BOOL" {
+			names[FormatAddress(t.addr.Offset, t.addr.Bit)] = t.Name
+		}
+	}
+	for _, item := range strings.Split(str, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("niepoprawna nazwa " + item + " (adres:nazwa)")
+		}
+		addr, err := ParseAddress(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		names[AddressKey(addr)] = strings.TrimSpace(parts[1])
+	}
+	return names, nil
+}
+
+// ChangingBits - Sygnały bitowe które zmieniają się w timeline
+// ================================================================================================
+func ChangingBits(timeline []MachineImage) []Signal {
+	var diff [imageSize]byte
+	for i := 1; i < len(timeline); i++ {
+		for index := 0; index < imageSize; index++ {
+			diff[index] |= timeline[i].IOImage[index] ^ timeline[i-1].IOImage[index]
+		}
+	}
+	var signals []Signal
+	for index := 0; index < imageSize; index++ {
+		for bit := 0; bit < 8; bit++ {
+			if diff[index]&(1<<uint(bit)) != 0 {
+				name := FormatAddress(index, bit)
+				signals = append(signals, Signal{Name: name, addr: Address{Offset: index, Bit: bit, Size: 1}})
+			}
+		}
+	}
+	return signals
+}
+
+// value - Wartość sygnału w zapisie VCD
+// ================================================================================================
+func (w *vcdWire) value(image [imageSize]byte) string {
+	if w.width == 0 {
+		f, _ := w.signal.tag.Numeric(image)
+		return "r" + strconv.FormatFloat(f, 'g', -1, 64) + " " + w.id
+	}
+	v := w.signal.Value(image)
+	if b, ok := v.(bool); ok {
+		if b {
+			return "1" + w.id
+		}
+		return "0" + w.id
+	}
+	var n uint64
+	switch x := v.(type) {
+	case byte:
+		n = uint64(x)
+	case uint16:
+		n = uint64(x)
+	case uint32:
+		n = uint64(x)
+	case int16:
+		n = uint64(uint16(x))
+	case int32:
+		n = uint64(uint32(x))
+	case int64:
+		n = uint64(x)
+	}
+	return "b" + strconv.FormatUint(n, 2) + " " + w.id
+}
+
+// WriteVCD - Zapis przebiegów w formacie Value Change Dump (GTKWave)
+// Czas w mikrosekundach od pierwszego obrazu
+// ================================================================================================
+func WriteVCD(out io.Writer, timeline []MachineImage, signals []Signal, names map[string]string) error {
+	if len(timeline) == 0 {
+		return errors.New("brak obrazów w wybranym przedziale czasu")
+	}
+	if len(signals) == 0 {
+		signals = ChangingBits(timeline)
+	}
+
+	var wires []*vcdWire
+	for _, s := range signals {
+		w := &vcdWire{id: vcdID(len(wires)), name: s.Name, signal: s}
+		if name, ok := names[AddressKey(s.addr)]; ok && s.tag == nil {
+			w.name = name
+		}
+		switch {
+		case s.addr.Bit >= 0:
+			w.width = 1
+		case s.tag != nil && s.tag.Type == "REAL":
+			w.width = 0
+		case s.tag != nil && (s.tag.Type == "STRING" || s.tag.Type == "DT" || s.tag.Type == "DTL" || s.tag.Type == "CHAR"):
+			log.Println("VCD: skipping signal", s.Name, "of type", s.tag.Type)
+			continue
+		case s.tag != nil && s.tag.Type == "S5TIME":
+			// wartość w ms (do 9990 s) nie mieści się w 16 bitach zapisu S5TIME
+			w.width = 32
+		default:
+			w.width = s.addr.Size * 8
+		}
+		wires = append(wires, w)
+	}
+
+	bw := bufio.NewWriter(out)
+	start := timeline[0].Timestamp
+	fmt.Fprintf(bw, "$date %s $end\n", time.Unix(0, start).Format(time.RFC3339Nano))
+	fmt.Fprintf(bw, "$version %s $end\n", strings.TrimSpace("S7 "+plcAddress))
+	fmt.Fprintf(bw, "$timescale 1us $end\n")
+	fmt.Fprintf(bw, "$scope module plc $end\n")
+	for _, w := range wires {
+		if w.width == 0 {
+			fmt.Fprintf(bw, "$var real 64 %s %s $end\n", w.id, vcdName(w.name))
+		} else {
+			fmt.Fprintf(bw, "$var wire %d %s %s $end\n", w.width, w.id, vcdName(w.name))
+		}
+	}
+	fmt.Fprintf(bw, "$upscope $end\n$enddefinitions $end\n")
+
+	fmt.Fprintf(bw, "#0\n$dumpvars\n")
+	for _, w := range wires {
+		w.last = w.value(timeline[0].IOImage)
+		fmt.Fprintln(bw, w.last)
+	}
+	fmt.Fprintf(bw, "$end\n")
+
+	for _, image := range timeline[1:] {
+		stamp := false
+		for _, w := range wires {
+			v := w.value(image.IOImage)
+			if v == w.last {
+				continue
+			}
+			if !stamp {
+				fmt.Fprintf(bw, "#%d\n", (image.Timestamp-start)/1000)
+				stamp = true
+			}
+			fmt.Fprintln(bw, v)
+			w.last = v
+		}
+	}
+	fmt.Fprintf(bw, "#%d\n", (timeline[len(timeline)-1].Timestamp-start)/1000)
+	return bw.Flush()
+}
+
+// GetVCD - Pobranie przebiegów w formacie VCD (from, to, signals, names)
+// ================================================================================================
+func GetVCD(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	log.Println("GetVCD()")
+
+	from, err := ParseTimeParam(c.Query("from"), 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := ParseTimeParam(c.Query("to"), math.MaxInt64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	signals, err := ParseSignals(c.Query("signals"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	names, err := ParseNames(c.Query("names"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	images := TimelineWindow(machineTimeline, from, to, nil, false)
+	if len(images) == 0 {
+		c.JSON(http.StatusNotFound, "Brak obrazów w wybranym przedziale czasu")
+		return
+	}
+
+	c.Header("Content-Type", "text/plain")
+	c.Header("Content-Disposition", "attachment; filename=s7-"+strconv.FormatInt(images[0].Timestamp/1000000000, 10)+".vcd")
+	c.Status(http.StatusOK)
+	ErrCheck(WriteVCD(c.Writer, images, signals, names))
+}
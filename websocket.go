@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// wsUpgrader - Przejście z HTTP na WebSocket (CORS jak w pozostałych endpointach)
+// ========================================================
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsEventTypes - Typy zdarzeń dostępne w subskrypcji
+// ========================================================
+var wsEventTypes = []string{"image", "state", "transition", "cycle", "cycles", "anomaly", "cpu"}
+
+// WsRequest - Polecenie klienta WebSocket
+// Action: "subscribe" (nowa lub zmiana subskrypcji o danym ID), "unsubscribe"
+// Interval - minimalny odstęp między obrazami [ms], pozostałe zdarzenia bez ograniczenia
+// ========================================================
+type WsRequest struct {
+	Action   string   `json:"Action"`
+	ID       string   `json:"ID"`
+	Sessions []string `json:"Sessions"`
+	Signals  []string `json:"Signals"`
+	Events   []string `json:"Events"`
+	Interval int      `json:"Interval"`
+}
+
+// WsMessage - Wiadomość do klienta WebSocket
+// Delta - pary [offset, wartość] zmienionych bajtów od ostatniego obrazu wysłanego w subskrypcji
+// ========================================================
+type WsMessage struct {
+	Subscription string                 `json:"Subscription,omitempty"`
+	Session      string                 `json:"Session,omitempty"`
+	Type         string                 `json:"Type"`
+	Time         int64                  `json:"Time,omitempty"`
+	Full         bool                   `json:"Full,omitempty"`
+	Delta        [][2]int               `json:"Delta,omitempty"`
+	Values       map[string]interface{} `json:"Values,omitempty"`
+	Data         interface{}            `json:"Data,omitempty"`
+	Error        string                 `json:"Error,omitempty"`
+}
+
+// wsSubscription - Subskrypcja klienta WebSocket
+// ========================================================
+type wsSubscription struct {
+	req      WsRequest
+	signals  []Signal
+	offsets  []int // bajty obrazu objęte subskrypcją
+	sessions map[string]bool
+	events   map[string]bool
+	last     map[string]*[imageSize]byte // ostatni wysłany obraz dla sesji
+	sent     map[string]int64
+}
+
+// newSubscription - Subskrypcja z polecenia klienta
+// ================================================================================================
+func newSubscription(req WsRequest) (*wsSubscription, string) {
+	if req.ID == "" {
+		return nil, "brak ID subskrypcji"
+	}
+	if req.Interval < 0 {
+		return nil, "niepoprawny Interval"
+	}
+	s := &wsSubscription{
+		req:      req,
+		sessions: map[string]bool{},
+		events:   map[string]bool{},
+		last:     map[string]*[imageSize]byte{},
+		sent:     map[string]int64{},
+	}
+	for _, name := range req.Signals {
+		signals, err := ParseSignals(name)
+		if err != nil {
+			return nil, err.Error()
+		}
+		s.signals = append(s.signals, signals...)
+	}
+
+	var covered [imageSize]bool
+	for _, sig := range s.signals {
+		for i := sig.addr.Offset; i < sig.addr.Offset+sig.addr.Size; i++ {
+			covered[i] = true
+		}
+	}
+	for i := range covered {
+		if covered[i] || len(s.signals) == 0 {
+			s.offsets = append(s.offsets, i)
+		}
+	}
+
+	for _, session := range req.Sessions {
+		s.sessions[session] = true
+	}
+	events := req.Events
+	if len(events) == 0 {
+		events = wsEventTypes
+	}
+	for _, e := range events {
+		known := false
+		for _, t := range wsEventTypes {
+			known = known || e == t
+		}
+		if !known {
+			return nil, "nieznany typ zdarzenia " + e
+		}
+		s.events[e] = true
+	}
+	return s, ""
+}
+
+// message - Wiadomość dla zdarzenia (false gdy subskrypcja go nie obejmuje)
+// ================================================================================================
+func (s *wsSubscription) message(e Event) (WsMessage, bool) {
+	msg := WsMessage{Subscription: s.req.ID, Session: e.Session, Type: e.Type, Time: e.Time}
+	if !s.events[e.Type] || len(s.sessions) > 0 && !s.sessions[e.Session] {
+		return msg, false
+	}
+	if e.Type != "image" {
+		msg.Data = e.Data
+		return msg, true
+	}
+
+	if e.Time-s.sent[e.Session] < int64(s.req.Interval)*1000000 {
+		return msg, false
+	}
+	last := s.last[e.Session]
+	msg.Full = last == nil
+	for _, i := range s.offsets {
+		if last == nil || last[i] != e.Image[i] {
+			msg.Delta = append(msg.Delta, [2]int{i, int(e.Image[i])})
+		}
+	}
+	if len(msg.Delta) == 0 {
+		return msg, false
+	}
+	if len(s.signals) > 0 {
+		msg.Values = map[string]interface{}{}
+		for _, sig := range s.signals {
+			msg.Values[sig.Name] = sig.Value(*e.Image)
+		}
+	}
+
+	image := *e.Image
+	s.last[e.Session] = &image
+	s.sent[e.Session] = e.Time
+	return msg, true
+}
+
+// WsHandler - Strumień zdarzeń przez WebSocket z subskrypcjami
+// ================================================================================================
+func WsHandler(c *gin.Context) {
+	log.Println("WsHandler()")
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WebSocket:", err)
+		return
+	}
+	defer conn.Close()
+
+	id, events := SubscribeEvents()
+	defer UnsubscribeEvents(id)
+
+	// polecenia klienta czytane w osobnym wątku, subskrypcje obsługuje tylko pętla poniżej
+	requests := make(chan WsRequest)
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(gone)
+		for {
+			var req WsRequest
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			select {
+			case requests <- req:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	subscriptions := map[string]*wsSubscription{}
+	for {
+		select {
+		case <-gone:
+			log.Println("WebSocket client gone")
+			return
+		case req := <-requests:
+			reply := WsMessage{Subscription: req.ID, Type: req.Action}
+			switch req.Action {
+			case "subscribe":
+				s, errStr := newSubscription(req)
+				if s != nil {
+					subscriptions[req.ID] = s
+				} else {
+					reply.Type, reply.Error = "error", errStr
+				}
+			case "unsubscribe":
+				delete(subscriptions, req.ID)
+			default:
+				reply.Type, reply.Error = "error", "nieznana akcja "+req.Action
+			}
+			if err := conn.WriteJSON(reply); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			for _, s := range subscriptions {
+				if msg, ok := s.message(e); ok {
+					if err := conn.WriteJSON(msg); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+}